@@ -0,0 +1,509 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/blang/semver/v4"
+	test "github.com/ipfs/ipfs-update/test-dist"
+	"github.com/ipfs/ipfs-update/util"
+	"github.com/ipfs/kubo/repo/fsrepo/migrations"
+	"github.com/whyrusleeping/stump"
+)
+
+// daemonStopTimeout bounds how long a daemon may take to shut down.
+const daemonStopTimeout = 2 * time.Minute
+
+// AutoUpdate installs new versions unattended.
+type AutoUpdate struct {
+	// MaxUpdate is the largest kind of update installed automatically.
+	MaxUpdate Update
+	// Window restricts installs to a maintenance window. Updates are still
+	// downloaded and verified outside of it. If nil, installs may happen at
+	// any time.
+	Window *Window
+	// StopCmd and StartCmd are shell commands stopping and starting the ipfs
+	// daemon around the install, e.g. "systemctl stop ipfs". If StopCmd is
+	// empty, a running daemon is shut down through its api. StartCmd must be
+	// set if a daemon is running.
+	StopCmd  string
+	StartCmd string
+	// HealthTimeout bounds how long the restarted daemon may take to come
+	// up running the new version before the install is reverted.
+	HealthTimeout time.Duration
+	// LockWait is how long to wait for another update to finish before
+	// giving up on this check.
+	LockWait time.Duration
+
+	// RolloutPeriod spreads the installs of a new version across a fleet:
+	// each node waits between zero and RolloutPeriod after first finding the
+	// version, depending on its peer id. Zero installs right away.
+	RolloutPeriod time.Duration
+	// RolloutGate is a file or URL holding a RolloutGate, consulted before
+	// downloading a new version and again before installing it. If it cannot
+	// be read, nothing is installed.
+	RolloutGate string
+
+	// Checks selects the optional checks run against the new binary.
+	Checks test.Checks
+	// Policy restricts the versions that may be installed.
+	Policy *Policy
+	// DistRoot, if set, is the root of the distribution site the fetcher
+	// uses. It is resolved again on each check, so that new releases are
+	// found.
+	DistRoot *DistRoot
+
+	fetcher migrations.Fetcher
+
+	// when a rollout deferred by RunOnce is due, zero if there is none
+	retryAt time.Time
+}
+
+// NewAutoUpdate returns an AutoUpdate installing patch releases.
+func NewAutoUpdate(fetcher migrations.Fetcher) *AutoUpdate {
+	return &AutoUpdate{
+		MaxUpdate:     PatchUpdate,
+		HealthTimeout: 2 * time.Minute,
+		Policy:        defaultPolicy(),
+		fetcher:       fetcher,
+	}
+}
+
+// RunOnce checks for the newest version within MaxUpdate and, if there is
+// one, downloads and verifies it, waits for the maintenance window without
+// holding the update lock and installs it, restarting the daemon if one is
+// running. If the restarted daemon does not come up healthy, the install is
+// reverted.
+func (a *AutoUpdate) RunOnce(ctx context.Context) error {
+	lock, err := AcquireLock(ctx, a.LockWait)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if lock != nil {
+			lock.Close()
+		}
+	}()
+
+	if a.DistRoot != nil {
+		a.DistRoot.Reset()
+	}
+
+	current, err := CurrentIpfsVersion()
+	if err != nil {
+		return err
+	}
+	if current == "none" {
+		return errors.New("no ipfs installation found to update")
+	}
+
+	vs, err := migrations.DistVersions(ctx, a.fetcher, "kubo", true)
+	if err != nil {
+		return fmt.Errorf("failed to query versions: %s", err)
+	}
+
+	latest, update, skipped := newestUpdate(vs, current, a.MaxUpdate, a.Policy)
+	if skipped != "" {
+		stump.Log("skipping update from %s to %s, only %s updates are installed automatically", current, skipped, a.MaxUpdate)
+	}
+	if latest == "" {
+		stump.Log("kubo %s is up to date", current)
+		return nil
+	}
+
+	stump.Log("%s update available: %s -> %s", update, current, latest)
+
+	a.retryAt = time.Time{}
+	var position float64
+	if a.RolloutPeriod != 0 || a.RolloutGate != "" {
+		peerID, err := RepoPeerID()
+		if err != nil {
+			return err
+		}
+		position = RolloutPosition(peerID, latest)
+		stump.VLog("rollout position of this node for %s is %.3f", latest, position)
+
+		ok, err := a.rolloutReady(ctx, latest, position)
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	i := NewInstall(latest, false, false, a.fetcher)
+	i.Checks = a.Checks
+	i.Policy = a.Policy
+
+	ready, err := i.Prepare(ctx)
+	if err != nil || !ready {
+		return err
+	}
+	applied := false
+	defer func() {
+		if !applied {
+			i.Discard()
+		}
+	}()
+
+	if now := time.Now(); a.Window != nil && a.Window.Next(now).After(now) {
+		// the window may be hours away, do not hold up other updates meanwhile
+		i.Suspend()
+		lock.Close()
+		lock = nil
+		err = a.Window.Wait(ctx)
+		if err != nil {
+			return err
+		}
+
+		lock, err = AcquireLock(ctx, a.LockWait)
+		if err != nil {
+			return err
+		}
+		err = i.Resume()
+		if err != nil {
+			return err
+		}
+	}
+
+	// the rollout may have been paused while downloading or waiting
+	ok, err := a.gateOpen(ctx, latest, position)
+	if err != nil || !ok {
+		return err
+	}
+
+	running := daemonRunning()
+	if running {
+		if a.StartCmd == "" {
+			return errors.New("a daemon is running, but no command to restart it was given")
+		}
+		err = a.stopDaemon(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// once the install starts, the daemon must be brought back up even if
+	// ctx is cancelled
+	bg := context.WithoutCancel(ctx)
+
+	applied = true
+	err = i.Apply(ctx)
+	if err != nil {
+		if running {
+			a.startDaemon(bg)
+		}
+		return err
+	}
+
+	if !running {
+		stump.Log("updated to %s", latest)
+		return nil
+	}
+
+	err = a.startDaemon(bg)
+	if err == nil {
+		err = a.waitHealthy(ctx, latest)
+	}
+	if err == nil {
+		stump.Log("updated to %s", latest)
+		return nil
+	}
+
+	stump.Error("daemon failed to come up after update: %s", err)
+	if daemonRunning() {
+		if serr := a.stopDaemon(bg); serr != nil {
+			stump.Error("failed to stop daemon: %s", serr)
+		}
+	}
+	rerr := i.Revert(bg)
+	if rerr != nil {
+		stump.Error("revert failed: %s", rerr)
+	}
+	a.startDaemon(bg)
+
+	return fmt.Errorf("update to %s reverted: %s", latest, err)
+}
+
+// newestUpdate returns the newest stable version in vs, which is sorted newest
+// first, that policy permits and that is an update of at most max from
+// current, and the kind of that update. It returns "" if there is none. If a
+// newer version was passed over for being a bigger update, it is returned as
+// skipped.
+func newestUpdate(vs []string, current string, max Update, policy *Policy) (vers string, update Update, skipped string) {
+	for _, v := range vs {
+		sv, err := semver.ParseTolerant(v)
+		if err != nil || len(sv.Pre) != 0 || strings.Contains(v, "-dev") {
+			continue
+		}
+		if policy.Check(v) != nil {
+			continue
+		}
+		u, err := ClassifyUpdate(current, v)
+		if err != nil || u == UpToDate {
+			// older versions follow
+			break
+		}
+		if u > max {
+			if skipped == "" {
+				skipped = v
+			}
+			continue
+		}
+		return v, u, skipped
+	}
+	return "", UpToDate, skipped
+}
+
+// rolloutReady reports whether the staged rollout lets the node at position
+// install vers now. If not, a.retryAt is set to when it will.
+func (a *AutoUpdate) rolloutReady(ctx context.Context, vers string, position float64) (bool, error) {
+	ok, err := a.gateOpen(ctx, vers, position)
+	if err != nil || !ok {
+		return ok, err
+	}
+
+	if a.RolloutPeriod == 0 {
+		return true, nil
+	}
+
+	st, err := LoadState()
+	if err != nil {
+		return false, err
+	}
+	if st.SeenVersion != vers {
+		st.SeenVersion = vers
+		st.SeenAt = time.Now()
+		err = saveState(st)
+		if err != nil {
+			return false, fmt.Errorf("could not record rollout state: %s", err)
+		}
+	}
+
+	due := rolloutDue(st.SeenAt, position, a.RolloutPeriod)
+	if time.Now().Before(due) {
+		stump.Log("rollout of %s to this node is due at %s", vers, due.Format(time.RFC3339))
+		a.retryAt = due
+		return false, nil
+	}
+	return true, nil
+}
+
+// gateOpen reports whether the rollout gate lets the node at position
+// install vers.
+func (a *AutoUpdate) gateOpen(ctx context.Context, vers string, position float64) (bool, error) {
+	if a.RolloutGate == "" {
+		return true, nil
+	}
+
+	g, err := LoadRolloutGate(ctx, a.RolloutGate)
+	if err != nil {
+		return false, err
+	}
+
+	err = g.Check(vers, position)
+	if err != nil {
+		stump.Log("not updating to %s: %s", vers, err)
+		return false, nil
+	}
+	return true, nil
+}
+
+// Run calls RunOnce every interval until ctx is cancelled. Errors are logged
+// rather than returned, so that a failed attempt is retried.
+func (a *AutoUpdate) Run(ctx context.Context, interval time.Duration) error {
+	for {
+		err := a.RunOnce(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			stump.Error("auto update failed: %s", err)
+		}
+
+		wait := interval
+		if !a.retryAt.IsZero() && time.Until(a.retryAt) < wait {
+			wait = time.Until(a.retryAt)
+		}
+
+		stump.VLog("next check at %s", time.Now().Add(wait).Format(time.RFC3339))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// daemonRunning reports whether a daemon is serving the api of the repo.
+func daemonRunning() bool {
+	ep, err := util.ApiEndpoint("")
+	if err != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c, err := ep.Dial(ctx)
+	if err != nil {
+		return false
+	}
+	c.Close()
+	return true
+}
+
+func (a *AutoUpdate) stopDaemon(ctx context.Context) error {
+	if a.StopCmd != "" {
+		stump.Log("stopping daemon: %s", a.StopCmd)
+		err := runShell(ctx, a.StopCmd)
+		if err != nil {
+			return fmt.Errorf("failed to stop daemon: %s", err)
+		}
+	} else {
+		stump.Log("shutting down daemon")
+		sh, _, err := ApiShell("")
+		if err != nil {
+			return fmt.Errorf("failed to stop daemon: %s", err)
+		}
+		err = sh.Request("shutdown").Exec(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to stop daemon: %s", err)
+		}
+	}
+
+	deadline := time.Now().Add(daemonStopTimeout)
+	for daemonRunning() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("daemon still running after %s", daemonStopTimeout)
+		}
+		time.Sleep(time.Second)
+	}
+	return nil
+}
+
+func (a *AutoUpdate) startDaemon(ctx context.Context) error {
+	stump.Log("starting daemon: %s", a.StartCmd)
+	err := runShell(ctx, a.StartCmd)
+	if err != nil {
+		stump.Error("failed to start daemon: %s", err)
+		return fmt.Errorf("failed to start daemon: %s", err)
+	}
+	return nil
+}
+
+// waitHealthy waits for the daemon to come up running version vers.
+func (a *AutoUpdate) waitHealthy(ctx context.Context, vers string) error {
+	stump.Log("waiting for daemon to come up...")
+	deadline := time.Now().Add(a.HealthTimeout)
+	for {
+		_, running, err := ApiShell("")
+		if err == nil {
+			if "v"+strings.TrimPrefix(running, "v") == vers {
+				return nil
+			}
+			return fmt.Errorf("daemon is running %s instead of %s", running, vers)
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("daemon did not come up within %s", a.HealthTimeout)
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// runShell runs cmd with the shell of the platform.
+func runShell(ctx context.Context, cmd string) error {
+	var c *exec.Cmd
+	if runtime.GOOS == "windows" {
+		c = exec.CommandContext(ctx, "cmd", "/C", cmd)
+	} else {
+		c = exec.CommandContext(ctx, "sh", "-c", cmd)
+	}
+	c.Stdout = os.Stderr
+	c.Stderr = os.Stderr
+	return c.Run()
+}
+
+// Window is a daily maintenance window in local time.
+type Window struct {
+	// Start and End are offsets from midnight. If End is before Start, the
+	// window spans midnight.
+	Start, End time.Duration
+}
+
+// ParseWindow parses a window such as "02:00-04:30".
+func ParseWindow(s string) (*Window, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid maintenance window %q, expected HH:MM-HH:MM", s)
+	}
+
+	start, err := parseClock(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid maintenance window %q: %s", s, err)
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return nil, fmt.Errorf("invalid maintenance window %q: %s", s, err)
+	}
+	if start == end {
+		return nil, fmt.Errorf("invalid maintenance window %q: empty", s)
+	}
+
+	return &Window{Start: start, End: end}, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Next returns t if it is inside the window, or else when the window opens
+// next.
+func (w *Window) Next(t time.Time) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+
+	if w.Start < w.End {
+		switch {
+		case offset < w.Start:
+			return midnight.Add(w.Start)
+		case offset < w.End:
+			return t
+		default:
+			return midnight.AddDate(0, 0, 1).Add(w.Start)
+		}
+	}
+
+	if offset >= w.Start || offset < w.End {
+		return t
+	}
+	return midnight.Add(w.Start)
+}
+
+// Wait blocks until the window is open or ctx is cancelled.
+func (w *Window) Wait(ctx context.Context) error {
+	now := time.Now()
+	next := w.Next(now)
+	if !next.After(now) {
+		return nil
+	}
+
+	stump.Log("waiting for maintenance window at %s", next.Format(time.RFC3339))
+	select {
+	case <-time.After(next.Sub(now)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	w, err := ParseWindow("02:00-04:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Start != 2*time.Hour || w.End != 4*time.Hour+30*time.Minute {
+		t.Errorf("unexpected window %v", w)
+	}
+
+	for _, s := range []string{"", "02:00", "02:00-02:00", "25:00-03:00", "2am-3am"} {
+		_, err := ParseWindow(s)
+		if err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+}
+
+func TestWindowNext(t *testing.T) {
+	day := func(d, h, m int) time.Time {
+		return time.Date(2024, 5, d, h, m, 0, 0, time.UTC)
+	}
+
+	cases := []struct {
+		window   string
+		now      time.Time
+		expected time.Time
+	}{
+		{"02:00-04:00", day(10, 1, 0), day(10, 2, 0)},
+		{"02:00-04:00", day(10, 3, 15), day(10, 3, 15)},
+		{"02:00-04:00", day(10, 4, 0), day(11, 2, 0)},
+		{"22:00-03:00", day(10, 23, 0), day(10, 23, 0)},
+		{"22:00-03:00", day(10, 1, 0), day(10, 1, 0)},
+		{"22:00-03:00", day(10, 12, 0), day(10, 22, 0)},
+	}
+	for _, c := range cases {
+		w, err := ParseWindow(c.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := w.Next(c.now)
+		if !next.Equal(c.expected) {
+			t.Errorf("%s at %s: expected %s, got %s", c.window, c.now, c.expected, next)
+		}
+	}
+}
+
+func TestNewestUpdate(t *testing.T) {
+	vs := []string{"v0.38.0-rc1", "v0.37.0", "v0.36.2", "v0.36.1", "v0.36.0", "v0.35.0"}
+	policy := defaultPolicy()
+
+	v, u, skipped := newestUpdate(vs, "v0.36.0", PatchUpdate, policy)
+	if v != "v0.36.2" || u != PatchUpdate || skipped != "v0.37.0" {
+		t.Errorf("expected the newest patch release, got %s (%s), skipped %s", v, u, skipped)
+	}
+
+	v, _, skipped = newestUpdate(vs, "v0.36.0", MajorUpdate, policy)
+	if v != "v0.37.0" || skipped != "" {
+		t.Errorf("expected the latest release, got %s, skipped %s", v, skipped)
+	}
+
+	v, _, skipped = newestUpdate(vs, "v0.36.2", PatchUpdate, policy)
+	if v != "" || skipped != "v0.37.0" {
+		t.Errorf("expected no update within patch releases, got %s, skipped %s", v, skipped)
+	}
+
+	v, _, _ = newestUpdate(vs, "v0.37.0", MajorUpdate, policy)
+	if v != "" {
+		t.Errorf("expected no update, got %s", v)
+	}
+}
@@ -0,0 +1,78 @@
+package lib
+
+import (
+	"fmt"
+
+	"github.com/blang/semver/v4"
+)
+
+// Update classifies how an available version differs from the installed one.
+type Update int
+
+const (
+	// UpToDate means the installed version is the newest one.
+	UpToDate Update = iota
+	// PatchUpdate means a newer patch release is available.
+	PatchUpdate
+	// MinorUpdate means a newer minor release is available.
+	MinorUpdate
+	// MajorUpdate means a newer major release, or one requiring a repo
+	// migration, is available.
+	MajorUpdate
+)
+
+func (u Update) String() string {
+	switch u {
+	case UpToDate:
+		return "none"
+	case PatchUpdate:
+		return "patch"
+	case MinorUpdate:
+		return "minor"
+	case MajorUpdate:
+		return "major"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseUpdate parses the name of a kind of update as returned by String.
+func ParseUpdate(s string) (Update, error) {
+	for _, u := range []Update{UpToDate, PatchUpdate, MinorUpdate, MajorUpdate} {
+		if u.String() == s {
+			return u, nil
+		}
+	}
+	return UpToDate, fmt.Errorf("unknown kind of update %q, expected patch, minor or major", s)
+}
+
+// ClassifyUpdate returns the kind of update going from the installed version
+// to the available one is. An update requiring a repo migration is treated
+// as a major update, since it cannot be reverted without migrating back.
+func ClassifyUpdate(installed, available string) (Update, error) {
+	cur, err := semver.ParseTolerant(installed)
+	if err != nil {
+		return UpToDate, err
+	}
+	next, err := semver.ParseTolerant(available)
+	if err != nil {
+		return UpToDate, err
+	}
+
+	if next.LTE(cur) {
+		return UpToDate, nil
+	}
+
+	curRepo, ok1 := RequiredRepoVersion(installed)
+	nextRepo, ok2 := RequiredRepoVersion(available)
+	switch {
+	case next.Major != cur.Major:
+		return MajorUpdate, nil
+	case ok1 && ok2 && curRepo != nextRepo:
+		return MajorUpdate, nil
+	case next.Minor != cur.Minor:
+		return MinorUpdate, nil
+	default:
+		return PatchUpdate, nil
+	}
+}
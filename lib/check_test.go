@@ -0,0 +1,43 @@
+package lib
+
+import "testing"
+
+func TestClassifyUpdate(t *testing.T) {
+	cases := []struct {
+		installed, available string
+		expected             Update
+	}{
+		{"v0.36.0", "v0.36.0", UpToDate},
+		{"v0.36.1", "v0.36.0", UpToDate},
+		{"v0.36.0", "v0.36.1", PatchUpdate},
+		{"v0.33.0", "v0.34.1", MinorUpdate},
+		{"v0.31.0", "v0.32.0", MajorUpdate},
+		{"v0.36.0", "v1.0.0", MajorUpdate},
+	}
+	for _, c := range cases {
+		u, err := ClassifyUpdate(c.installed, c.available)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u != c.expected {
+			t.Errorf("%s -> %s: expected %s, got %s", c.installed, c.available, c.expected, u)
+		}
+	}
+}
+
+func TestParseUpdate(t *testing.T) {
+	for _, u := range []Update{PatchUpdate, MinorUpdate, MajorUpdate} {
+		p, err := ParseUpdate(u.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p != u {
+			t.Errorf("expected %s, got %s", u, p)
+		}
+	}
+
+	_, err := ParseUpdate("huge")
+	if err == nil {
+		t.Error("expected error parsing unknown update")
+	}
+}
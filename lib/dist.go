@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"runtime"
+	"sort"
+
+	"github.com/ipfs/kubo/repo/fsrepo/migrations"
+)
+
+// DistInfo is the release metadata published as dist.json next to the
+// archives of each version on the distribution site.
+type DistInfo struct {
+	ID        string                  `json:"id"`
+	Version   string                  `json:"version"`
+	Platforms map[string]DistPlatform `json:"platforms"`
+}
+
+// DistPlatform lists the archives built for an operating system.
+type DistPlatform struct {
+	Name  string                  `json:"name"`
+	Archs map[string]DistArtifact `json:"archs"`
+}
+
+// DistArtifact describes the archive built for a platform.
+type DistArtifact struct {
+	Link   string `json:"link"`
+	CID    string `json:"cid"`
+	SHA512 string `json:"sha512"`
+}
+
+// Platform is an operating system and architecture releases are built for,
+// named as GOOS and GOARCH.
+type Platform struct {
+	OS   string
+	Arch string
+}
+
+// CurrentPlatform returns the platform ipfs-update runs on.
+func CurrentPlatform() Platform {
+	return Platform{OS: runtime.GOOS, Arch: runtime.GOARCH}
+}
+
+func (p Platform) String() string {
+	return p.OS + "-" + p.Arch
+}
+
+// ExeName returns the file name of the executable name on p.
+func (p Platform) ExeName(name string) string {
+	if p.OS == "windows" {
+		return name + ".exe"
+	}
+	return name
+}
+
+// FetchDistInfo fetches the release metadata of version vers of dist.
+func FetchDistInfo(ctx context.Context, fetcher migrations.Fetcher, dist, vers string) (*DistInfo, error) {
+	data, err := fetcher.Fetch(ctx, path.Join(dist, vers, "dist.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	info := new(DistInfo)
+	err = json.Unmarshal(data, info)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse dist.json of %s %s: %s", dist, vers, err)
+	}
+	return info, nil
+}
+
+// Artifact returns the archive built for goos and goarch, if there is one.
+func (d *DistInfo) Artifact(goos, goarch string) (DistArtifact, bool) {
+	a, ok := d.Platforms[goos].Archs[goarch]
+	return a, ok
+}
+
+// Builds returns the platforms archives were built for, sorted.
+func (d *DistInfo) Builds() []Platform {
+	var builds []Platform
+	for goos, p := range d.Platforms {
+		for goarch := range p.Archs {
+			builds = append(builds, Platform{OS: goos, Arch: goarch})
+		}
+	}
+	sort.Slice(builds, func(i, j int) bool {
+		return builds[i].String() < builds[j].String()
+	})
+	return builds
+}
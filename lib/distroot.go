@@ -0,0 +1,156 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/ipfs/kubo/repo/fsrepo/migrations"
+	"github.com/whyrusleeping/stump"
+)
+
+// maxDNSLinkDepth bounds the chains of DNSLink records pointing to other
+// DNSLink names.
+const maxDNSLinkDepth = 32
+
+// PathResolver resolves a mutable ipfs path, such as an IPNS name or a
+// DNSLink, to an immutable /ipfs path.
+type PathResolver interface {
+	ResolvePath(ctx context.Context, p string) (string, error)
+}
+
+// DistRoot is the root of the distribution site. It is resolved to an
+// immutable /ipfs path the first time it is needed, so that all the files
+// fetched by an invocation come from the same snapshot of the site, even if
+// it is republished meanwhile.
+type DistRoot struct {
+	path      string
+	resolvers []PathResolver
+
+	mu       sync.Mutex
+	resolved string
+}
+
+// NewDistRoot returns the root of the distribution site at distPath, resolved
+// by the first of resolvers that succeeds.
+//
+// Specifying "" for distPath sets the default IPNS path.
+func NewDistRoot(distPath string, resolvers ...PathResolver) *DistRoot {
+	if distPath == "" {
+		distPath = migrations.LatestIpfsDist
+	}
+	if !strings.HasPrefix(distPath, "/") {
+		distPath = "/" + distPath
+	}
+	return &DistRoot{path: distPath, resolvers: resolvers}
+}
+
+// Path returns the resolved root, resolving it if needed. If it cannot be
+// resolved, the unresolved path is used for the rest of the invocation.
+func (d *DistRoot) Path(ctx context.Context) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.resolved != "" {
+		return d.resolved
+	}
+
+	if strings.HasPrefix(d.path, "/ipfs/") {
+		stump.VLog("using dist %s", d.path)
+		d.resolved = d.path
+		return d.resolved
+	}
+
+	for _, r := range d.resolvers {
+		p, err := r.ResolvePath(ctx, d.path)
+		if err == nil && !strings.HasPrefix(p, "/ipfs/") {
+			err = fmt.Errorf("not an immutable path: %s", p)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				// try again next time rather than give up on resolving
+				return d.path
+			}
+			stump.VLog("could not resolve %s with %T: %s", d.path, r, err)
+			continue
+		}
+		stump.Log("using dist %s, resolved from %s", p, d.path)
+		d.resolved = p
+		return d.resolved
+	}
+
+	// a warning on the log output, which the commands printing machine
+	// readable output send to stderr
+	stump.Log("WARNING: could not resolve %s, files may come from different snapshots of it", d.path)
+	d.resolved = d.path
+	return d.resolved
+}
+
+// Reset forgets the resolved root, so that it is resolved again the next
+// time it is needed, e.g. on each check of a long running update.
+func (d *DistRoot) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.resolved = ""
+}
+
+// DNSLinkResolver resolves /ipns paths whose name is a domain with its
+// DNSLink TXT record, without going through an ipfs node or a gateway.
+type DNSLinkResolver struct {
+	// lookupTXT looks up TXT records, net.DefaultResolver if nil
+	lookupTXT func(ctx context.Context, name string) ([]string, error)
+}
+
+// ResolvePath implements PathResolver.
+func (r DNSLinkResolver) ResolvePath(ctx context.Context, p string) (string, error) {
+	lookup := r.lookupTXT
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupTXT
+	}
+
+	for range maxDNSLinkDepth {
+		rest, ok := strings.CutPrefix(p, "/ipns/")
+		if !ok {
+			return p, nil
+		}
+		name, sub, _ := strings.Cut(rest, "/")
+		if !strings.Contains(name, ".") {
+			return "", fmt.Errorf("%s is not a DNSLink name", name)
+		}
+
+		link, err := lookupDNSLink(ctx, lookup, name)
+		if err != nil {
+			return "", err
+		}
+		p = strings.TrimSuffix(link, "/")
+		if sub != "" {
+			p += "/" + sub
+		}
+	}
+	return "", errors.New("too many DNSLink indirections")
+}
+
+// lookupDNSLink returns the path the DNSLink record of name points to,
+// looking up _dnslink.name before name itself.
+func lookupDNSLink(ctx context.Context, lookup func(context.Context, string) ([]string, error), name string) (string, error) {
+	var lastErr error
+	for _, host := range []string{"_dnslink." + name, name} {
+		txts, err := lookup(ctx, host)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, txt := range txts {
+			link, ok := strings.CutPrefix(strings.TrimSpace(txt), "dnslink=")
+			if ok && (strings.HasPrefix(link, "/ipfs/") || strings.HasPrefix(link, "/ipns/")) {
+				return link, nil
+			}
+		}
+	}
+	if lastErr != nil {
+		return "", lastErr
+	}
+	return "", fmt.Errorf("no DNSLink record for %s", name)
+}
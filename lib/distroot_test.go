@@ -0,0 +1,118 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fakeResolver struct {
+	path  string
+	err   error
+	calls int
+}
+
+func (r *fakeResolver) ResolvePath(ctx context.Context, p string) (string, error) {
+	r.calls++
+	return r.path, r.err
+}
+
+func TestDistRootResolvesOnce(t *testing.T) {
+	broken := &fakeResolver{err: errors.New("no node")}
+	good := &fakeResolver{path: "/ipfs/QmRoot"}
+	root := NewDistRoot("/ipns/dist.example", broken, good)
+
+	for range 3 {
+		if p := root.Path(context.Background()); p != "/ipfs/QmRoot" {
+			t.Fatalf("expected /ipfs/QmRoot, got %s", p)
+		}
+	}
+	if broken.calls != 1 || good.calls != 1 {
+		t.Errorf("expected one resolution, got %d and %d calls", broken.calls, good.calls)
+	}
+
+	good.path = "/ipfs/QmNewer"
+	root.Reset()
+	if p := root.Path(context.Background()); p != "/ipfs/QmNewer" {
+		t.Errorf("expected /ipfs/QmNewer after a reset, got %s", p)
+	}
+}
+
+func TestDistRootUnresolved(t *testing.T) {
+	mutable := &fakeResolver{path: "/ipns/other.example"}
+	root := NewDistRoot("dist.example", mutable)
+	if p := root.Path(context.Background()); p != "/dist.example" {
+		t.Errorf("expected the unresolved path, got %s", p)
+	}
+
+	r := &fakeResolver{path: "/ipfs/QmOther"}
+	root = NewDistRoot("/ipfs/QmPinned", r)
+	if p := root.Path(context.Background()); p != "/ipfs/QmPinned" {
+		t.Errorf("expected the pinned snapshot, got %s", p)
+	}
+	if r.calls != 0 {
+		t.Error("an /ipfs path should not be resolved")
+	}
+}
+
+func TestDNSLinkResolver(t *testing.T) {
+	records := map[string][]string{
+		"_dnslink.dist.example": {"v=spf1 -all", "dnslink=/ipns/other.example/dist"},
+		"other.example":         {"dnslink=/ipfs/QmRoot"},
+	}
+	r := DNSLinkResolver{lookupTXT: func(ctx context.Context, name string) ([]string, error) {
+		txts, ok := records[name]
+		if !ok {
+			return nil, errors.New("no such host")
+		}
+		return txts, nil
+	}}
+
+	p, err := r.ResolvePath(context.Background(), "/ipns/dist.example/kubo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != "/ipfs/QmRoot/dist/kubo" {
+		t.Errorf("unexpected path %s", p)
+	}
+
+	_, err = r.ResolvePath(context.Background(), "/ipns/missing.example")
+	if err == nil {
+		t.Error("expected an error without a DNSLink record")
+	}
+	_, err = r.ResolvePath(context.Background(), "/ipns/k51qzi5uqu5dlvj2")
+	if err == nil {
+		t.Error("expected an error for an IPNS key")
+	}
+}
+
+func TestHttpFetcherRoot(t *testing.T) {
+	var fetched []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			if r.URL.Path != "/ipns/dist.example/" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("X-Ipfs-Roots", "QmRoot")
+			return
+		}
+		fetched = append(fetched, r.URL.Path)
+		w.Write([]byte("v0.36.0\n"))
+	}))
+	defer srv.Close()
+
+	f := NewHttpFetcher("/ipns/dist.example", srv.URL, "", 0)
+	f.Root = NewDistRoot("/ipns/dist.example", f)
+	for range 2 {
+		_, err := f.Fetch(context.Background(), "kubo/versions")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(fetched) != 2 || fetched[0] != "/ipfs/QmRoot/kubo/versions" || fetched[1] != fetched[0] {
+		t.Errorf("expected files to be fetched from the resolved root, got %v", fetched)
+	}
+}
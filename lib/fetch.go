@@ -0,0 +1,530 @@
+package lib
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ipfs/ipfs-update/util"
+	"github.com/ipfs/kubo/repo/fsrepo/migrations"
+	"github.com/whyrusleeping/stump"
+)
+
+// StreamFetcher is a Fetcher that can stream files instead of holding them in
+// memory, for downloading large archives.
+type StreamFetcher interface {
+	migrations.Fetcher
+	// Open starts fetching the file at filePath. The caller must close the
+	// returned reader.
+	Open(ctx context.Context, filePath string) (io.ReadCloser, error)
+}
+
+// openFile starts fetching filePath with f, which is buffered in memory if f
+// cannot stream it.
+func openFile(ctx context.Context, f migrations.Fetcher, filePath string) (io.ReadCloser, error) {
+	if sf, ok := f.(StreamFetcher); ok {
+		return sf.Open(ctx, filePath)
+	}
+
+	data, err := f.Fetch(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// fetchAttempts flattens a chain of multi and retry fetchers into the list of
+// fetchers to try in turn, so that a download that fails part way can be
+// restarted from another source.
+func fetchAttempts(f migrations.Fetcher) []migrations.Fetcher {
+	switch f := f.(type) {
+	case *migrations.MultiFetcher:
+		var attempts []migrations.Fetcher
+		for _, sub := range f.Fetchers() {
+			attempts = append(attempts, fetchAttempts(sub)...)
+		}
+		return attempts
+	case *migrations.RetryFetcher:
+		var attempts []migrations.Fetcher
+		inner := fetchAttempts(f.Fetcher)
+		for i := 0; i < f.MaxTries; i++ {
+			attempts = append(attempts, inner...)
+		}
+		return attempts
+	case *RaceFetcher:
+		// nested races are tried in turn
+		var attempts []migrations.Fetcher
+		for _, sub := range f.fetchers {
+			attempts = append(attempts, fetchAttempts(sub)...)
+		}
+		return attempts
+	case *sourceFetcher:
+		var attempts []migrations.Fetcher
+		for _, a := range fetchAttempts(f.Fetcher) {
+			attempts = append(attempts, &sourceFetcher{Fetcher: a, name: f.name})
+		}
+		return attempts
+	default:
+		return []migrations.Fetcher{f}
+	}
+}
+
+// RangeFetcher is a StreamFetcher that can resume an interrupted download.
+type RangeFetcher interface {
+	StreamFetcher
+	// OpenAt starts fetching the file at filePath from offset. It returns the
+	// offset the returned reader actually starts at, which is 0 if the source
+	// cannot resume.
+	OpenAt(ctx context.Context, filePath string, offset int64) (io.ReadCloser, int64, error)
+}
+
+// openFileAt starts fetching filePath with f from offset, or from the start
+// if f cannot resume downloads.
+func openFileAt(ctx context.Context, f migrations.Fetcher, filePath string, offset int64) (io.ReadCloser, int64, error) {
+	if rf, ok := f.(RangeFetcher); ok && offset > 0 {
+		return rf.OpenAt(ctx, filePath, offset)
+	}
+	rc, err := openFile(ctx, f, filePath)
+	return rc, 0, err
+}
+
+const (
+	// downloadsDir is the directory in the ipfs directory keeping partial
+	// downloads, so that they can be resumed by the next run.
+	downloadsDir = "update-downloads"
+	// partialMaxAge is how long partial downloads are kept.
+	partialMaxAge = 7 * 24 * time.Hour
+)
+
+// partialDownload is the file a download is written to until it completes.
+type partialDownload struct {
+	path string
+	// lock on the partial download, nil for a private one
+	lock *util.Lock
+	// private directory holding a private partial download
+	private string
+}
+
+// openPartial returns where the partial download of filePath with fetcher is
+// kept, locked so that no other process writes to it. If another process is
+// downloading the same file, a private partial download is used instead,
+// which is not resumed later. If there is no ipfs directory, the temporary
+// directory is used instead.
+func openPartial(ctx context.Context, fetcher migrations.Fetcher, filePath string) (*partialDownload, error) {
+	dir := filepath.Join(os.TempDir(), "ipfs-update-downloads")
+	if ipfsDir, err := migrations.CheckIpfsDir(""); err == nil {
+		dir = filepath.Join(ipfsDir, downloadsDir)
+	}
+
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	removeStalePartials(dir)
+
+	// the same path may hold different files in other snapshots of the dist
+	name := strings.ReplaceAll(strings.Trim(downloadRoot(ctx, fetcher)+"/"+filePath, "/"), "/", "_") + ".part"
+	path := filepath.Join(dir, name)
+	lock, err := util.TryLock(path + ".lock")
+	if err == nil {
+		return &partialDownload{path: path, lock: lock}, nil
+	}
+	if !errors.Is(err, util.ErrLocked) {
+		return nil, err
+	}
+
+	stump.VLog("%s is being downloaded by another process, downloading a private copy", filePath)
+	private, err := os.MkdirTemp(dir, "private-")
+	if err != nil {
+		return nil, err
+	}
+	return &partialDownload{path: filepath.Join(private, name), private: private}, nil
+}
+
+// Close releases the partial download, and removes it if it is private.
+func (p *partialDownload) Close() {
+	if p.lock != nil {
+		p.lock.Close()
+	}
+	if p.private != "" {
+		os.RemoveAll(p.private)
+	}
+}
+
+// downloadRoot returns the dist root the first fetcher of the chain fetches
+// from, or "" if it is not known.
+func downloadRoot(ctx context.Context, fetcher migrations.Fetcher) string {
+	for _, a := range fetchAttempts(fetcher) {
+		if sf, ok := a.(*sourceFetcher); ok {
+			a = sf.Fetcher
+		}
+		if d, ok := a.(interface{ dist(context.Context) string }); ok {
+			return d.dist(ctx)
+		}
+	}
+	return ""
+}
+
+// removeStalePartials removes partial downloads that have not been resumed
+// for a while, and private ones left behind by a crash. Their lock files are
+// kept, see util.TryLock.
+func removeStalePartials(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil || time.Since(fi.ModTime()) <= partialMaxAge {
+			continue
+		}
+		if strings.HasSuffix(e.Name(), ".part") || (e.IsDir() && strings.HasPrefix(e.Name(), "private-")) {
+			stump.VLog("removing stale partial download %s", e.Name())
+			os.RemoveAll(filepath.Join(dir, e.Name()))
+		}
+	}
+}
+
+// DownloadFile fetches the file at filePath into the file dest, trying the
+// fetchers in the chain in turn like Fetch would, but writing to disk as the
+// data arrives instead of holding it in memory. It returns the hex encoded
+// sha512 digest of the file, computed on the fly.
+//
+// If digest is not empty, the download must match that sha512 digest, and is
+// restarted from scratch if it does not. Failed downloads are then kept and
+// resumed where they stopped, by this or a later call, from fetchers that
+// support it. Without a digest, downloads always start from scratch, as a
+// resumed download could not be verified.
+func DownloadFile(ctx context.Context, fetcher migrations.Fetcher, filePath, dest, digest string) (string, error) {
+	partial, err := openPartial(ctx, fetcher, filePath)
+	if err != nil {
+		return "", err
+	}
+	defer partial.Close()
+
+	var sum string
+	part := partial.path
+	if rf, ok := fetcher.(*RaceFetcher); ok && digest != "" {
+		sum, part, err = rf.download(ctx, filePath, part, digest)
+	} else {
+		// without a digest, the first download to complete cannot be told
+		// apart from a corrupt one, so racing fetchers are tried in turn
+		sum, err = downloadAttempts(ctx, fetchAttempts(fetcher), filePath, part, digest)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("could not fetch %s: %s", filePath, err)
+	}
+	return sum, movePartial(ctx, part, dest)
+}
+
+// downloadAttempts downloads filePath into the partial download part, with
+// each of attempts in turn until one succeeds.
+func downloadAttempts(ctx context.Context, attempts []migrations.Fetcher, filePath, part, digest string) (string, error) {
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var lastErr error
+	for _, a := range attempts {
+		sum, err := downloadFrom(ctx, a, filePath, f, digest != "")
+		if err == nil && digest != "" && !strings.EqualFold(sum, digest) {
+			err = fmt.Errorf("digest mismatch: expected sha512 %s, got %s", digest, sum)
+			if terr := f.Truncate(0); terr != nil {
+				return "", terr
+			}
+		}
+		if err == nil {
+			if digest != "" {
+				stump.VLog("verified sha512 %s", sum)
+			}
+			return sum, f.Close()
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		stump.Log("error fetching %s: %s", filePath, err)
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no fetchers")
+	}
+	return "", lastErr
+}
+
+// downloadFrom fetches filePath with fetcher into f, resuming after the data
+// already in f if resume is set and fetcher can. It returns the sha512 digest
+// of the whole file.
+func downloadFrom(ctx context.Context, fetcher migrations.Fetcher, filePath string, f *os.File, resume bool) (string, error) {
+	if !resume {
+		err := f.Truncate(0)
+		if err != nil {
+			return "", err
+		}
+	}
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+
+	rc, start, err := openFileAt(ctx, fetcher, filePath, offset)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	h := sha512.New()
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	if start > 0 {
+		stump.Log("resuming download of %s at %s", filePath, util.HumanBytes(start))
+		_, err = io.CopyN(h, f, start)
+	} else {
+		err = f.Truncate(0)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(io.MultiWriter(f, h), rc)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// movePartial moves a completed download to dest.
+func movePartial(ctx context.Context, part, dest string) error {
+	err := os.Rename(part, dest)
+	if err == nil {
+		return nil
+	}
+	return util.Move(ctx, part, dest)
+}
+
+// Archive is a release archive downloaded and verified by FetchBinary.
+type Archive struct {
+	// Path is where the archive was downloaded to.
+	Path string
+	// DistPath is the path of the archive on the distribution site.
+	DistPath string
+	// CID is the CID published for the archive in dist.json, or "" if there
+	// is none.
+	CID string
+	// SHA512 is the hex encoded sha512 digest of the archive.
+	SHA512 string
+}
+
+// FetchBinary downloads the archive of version ver of dist for the current
+// platform and unpacks the binary binName from it. It works like the function
+// of the same name in the migrations package, but streams the archive to disk,
+// resumes it if interrupted, and verifies it against the sha512 digest
+// published in dist.json, if there is one.
+//
+// If out is a directory, the binary is written to that directory with the
+// same name it has inside the archive. Otherwise, it is written to the file
+// named by out.
+func FetchBinary(ctx context.Context, fetcher migrations.Fetcher, dist, ver, binName, out string) (string, error) {
+	out, _, _, err := fetchBinary(ctx, fetcher, dist, ver, binName, out, fetchOptions{})
+	return out, err
+}
+
+// FetchBinaryFor works like FetchBinary, for platform p instead of the current
+// one. It also returns the digest of the downloaded archive, as
+// "sha512:<hex>", and the name of the source it was downloaded from, or "" if
+// that source is not tracked, see TrackSource.
+func FetchBinaryFor(ctx context.Context, fetcher migrations.Fetcher, dist, ver, binName, out string, p Platform) (string, string, string, error) {
+	return fetchBinary(ctx, fetcher, dist, ver, binName, out, fetchOptions{platform: p})
+}
+
+// fetchOptions changes how fetchBinary gets a binary.
+type fetchOptions struct {
+	// platform to get the binary for, the current one if zero
+	platform Platform
+	// artifact, if not nil, is the archive to download and its digest,
+	// instead of the one listed in dist.json
+	artifact *DistArtifact
+	// keep, if not nil, is called with the archive once the binary was
+	// unpacked from it, before the archive is removed
+	keep func(*Archive)
+}
+
+func fetchBinary(ctx context.Context, fetcher migrations.Fetcher, dist, ver, binName, out string, opts fetchOptions) (string, string, string, error) {
+	plat := opts.platform
+	if plat == (Platform{}) {
+		plat = CurrentPlatform()
+	}
+
+	arcName := filepath.Base(dist)
+	if binName == "" {
+		binName = arcName
+	}
+	binName = plat.ExeName(binName)
+
+	fi, err := os.Stat(out)
+	if err == nil && fi.IsDir() {
+		out = filepath.Join(out, binName)
+		_, err = os.Stat(out)
+	}
+	if err == nil {
+		return "", "", "", &os.PathError{Op: "FetchBinary", Path: out, Err: os.ErrExist}
+	}
+	if !os.IsNotExist(err) {
+		return "", "", "", err
+	}
+
+	tmpDir, err := os.MkdirTemp("", arcName)
+	if err != nil {
+		return "", "", "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	distPath := ArchivePath(dist, ver, plat.OS, plat.Arch)
+	arc := &Archive{
+		Path:     filepath.Join(tmpDir, filepath.Base(distPath)),
+		DistPath: distPath,
+	}
+
+	art := opts.artifact
+	if art == nil {
+		a, err := archiveArtifact(ctx, fetcher, dist, ver, plat)
+		if err != nil {
+			return "", "", "", err
+		}
+		art = &a
+	}
+	arc.CID = art.CID
+
+	var source string
+	arc.SHA512, err = DownloadFile(withSource(ctx, &source), fetcher, arc.DistPath, arc.Path, art.SHA512)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	err = unpackArchive(arc.Path, archiveType(plat.OS), dist, binName, out)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	err = os.Chmod(out, 0o755)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if opts.keep != nil {
+		opts.keep(arc)
+	}
+	return out, "sha512:" + arc.SHA512, source, nil
+}
+
+// archiveArtifact returns the dist.json entry of the archive of ver for
+// platform p. Its digest is empty for releases published without one.
+func archiveArtifact(ctx context.Context, fetcher migrations.Fetcher, dist, ver string, p Platform) (DistArtifact, error) {
+	info, err := FetchDistInfo(ctx, fetcher, dist, ver)
+	if err != nil {
+		if ctx.Err() != nil {
+			return DistArtifact{}, ctx.Err()
+		}
+		stump.Log("WARNING: the archive of %s %s for %s will not be verified, could not get dist.json: %s", dist, ver, p, err)
+		return DistArtifact{}, nil
+	}
+
+	art, ok := info.Artifact(p.OS, p.Arch)
+	if !ok || art.SHA512 == "" {
+		stump.Log("WARNING: the archive of %s %s for %s will not be verified, dist.json has no digest for it", dist, ver, p)
+	}
+	return art, nil
+}
+
+func unpackArchive(arcPath, atype, root, name, out string) error {
+	switch atype {
+	case "tar.gz":
+		return unpackTgz(arcPath, root, name, out)
+	case "zip":
+		return unpackZip(arcPath, root, name, out)
+	default:
+		return fmt.Errorf("unrecognized archive type: %s", atype)
+	}
+}
+
+func unpackTgz(arcPath, root, name, out string) error {
+	fi, err := os.Open(arcPath)
+	if err != nil {
+		return fmt.Errorf("cannot open archive file: %s", err)
+	}
+	defer fi.Close()
+
+	gzr, err := gzip.NewReader(fi)
+	if err != nil {
+		return fmt.Errorf("error opening gzip reader: %s", err)
+	}
+	defer gzr.Close()
+
+	tarr := tar.NewReader(gzr)
+	lookFor := root + "/" + name
+	for {
+		th, err := tarr.Next()
+		if err == io.EOF {
+			return errors.New("no binary found in archive")
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read archive: %s", err)
+		}
+
+		if th.Name == lookFor {
+			return writeToPath(tarr, out)
+		}
+	}
+}
+
+func unpackZip(arcPath, root, name, out string) error {
+	zipr, err := zip.OpenReader(arcPath)
+	if err != nil {
+		return fmt.Errorf("error opening zip reader: %s", err)
+	}
+	defer zipr.Close()
+
+	lookFor := root + "/" + name
+	for _, fis := range zipr.File {
+		if fis.Name != lookFor {
+			continue
+		}
+		rc, err := fis.Open()
+		if err != nil {
+			return fmt.Errorf("error extracting binary from archive: %s", err)
+		}
+		defer rc.Close()
+		return writeToPath(rc, out)
+	}
+	return errors.New("no binary found in archive")
+}
+
+func writeToPath(r io.Reader, out string) error {
+	f, err := os.Create(out)
+	if err != nil {
+		return fmt.Errorf("error creating output file '%s': %s", out, err)
+	}
+
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
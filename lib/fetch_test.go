@@ -0,0 +1,426 @@
+package lib
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/ipfs/kubo/repo/fsrepo/migrations"
+)
+
+// memFetcher serves files from memory.
+type memFetcher map[string][]byte
+
+func (f memFetcher) Fetch(ctx context.Context, filePath string) ([]byte, error) {
+	data, ok := f[filePath]
+	if !ok {
+		return nil, errors.New("not found: " + filePath)
+	}
+	return data, nil
+}
+
+func (f memFetcher) Close() error { return nil }
+
+// brokenFetcher streams the first half of each file, then fails.
+type brokenFetcher struct {
+	memFetcher
+	opened int
+}
+
+func (f *brokenFetcher) Open(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	f.opened++
+	data, err := f.Fetch(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	r := io.MultiReader(bytes.NewReader(data[:len(data)/2]), failReader{})
+	return io.NopCloser(r), nil
+}
+
+func TestDownloadFileFallback(t *testing.T) {
+	t.Setenv("IPFS_PATH", t.TempDir())
+	data := bytes.Repeat([]byte("kubo"), 10000)
+	files := memFetcher{"kubo/versions": data}
+	broken := &brokenFetcher{memFetcher: files}
+	fetcher := migrations.NewMultiFetcher(
+		TrackSource("broken", &migrations.RetryFetcher{Fetcher: broken, MaxTries: 2}),
+		TrackSource("good", files))
+
+	dest := filepath.Join(t.TempDir(), "versions")
+	var src string
+	sum, err := DownloadFile(withSource(context.Background(), &src), fetcher, "kubo/versions", dest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if broken.opened != 2 {
+		t.Errorf("expected 2 attempts with the broken fetcher, got %d", broken.opened)
+	}
+	if src != "good" {
+		t.Errorf("expected source good, got %q", src)
+	}
+
+	out, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Error("partial downloads were not discarded")
+	}
+	expected := sha512.Sum512(data)
+	if sum != hex.EncodeToString(expected[:]) {
+		t.Errorf("wrong digest %s", sum)
+	}
+}
+
+func TestDownloadFileFails(t *testing.T) {
+	t.Setenv("IPFS_PATH", t.TempDir())
+	dest := filepath.Join(t.TempDir(), "versions")
+	_, err := DownloadFile(context.Background(), memFetcher{}, "kubo/versions", dest, "")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+// partialFile returns the path of the partial download of filePath with
+// fetcher.
+func partialFile(t *testing.T, fetcher migrations.Fetcher, filePath string) string {
+	partial, err := openPartial(context.Background(), fetcher, filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial.Close()
+	return partial.path
+}
+
+// rangeServer serves data as every file, recording the ranges requested.
+func rangeServer(t *testing.T, data []byte) (*httptest.Server, *[]string) {
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &ranges
+}
+
+func TestDownloadFileResume(t *testing.T) {
+	t.Setenv("IPFS_PATH", t.TempDir())
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	srv, ranges := rangeServer(t, data)
+	fetcher := NewHttpFetcher("/ipns/dist.example.com", srv.URL, "", 0)
+
+	// an earlier run got half way
+	part := partialFile(t, fetcher, "kubo/v0.36.0/kubo.tar.gz")
+	err := os.WriteFile(part, data[:len(data)/2], 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := sha512.Sum512(data)
+	digest := hex.EncodeToString(expected[:])
+	dest := filepath.Join(t.TempDir(), "kubo.tar.gz")
+	sum, err := DownloadFile(context.Background(), fetcher, "kubo/v0.36.0/kubo.tar.gz", dest, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != digest {
+		t.Errorf("wrong digest %s", sum)
+	}
+	if len(*ranges) != 1 || (*ranges)[0] != fmt.Sprintf("bytes=%d-", len(data)/2) {
+		t.Errorf("expected one range request, got %q", *ranges)
+	}
+
+	out, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Error("resumed download is corrupt")
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Error("partial download was not removed")
+	}
+}
+
+func TestDownloadFileResumeMismatch(t *testing.T) {
+	t.Setenv("IPFS_PATH", t.TempDir())
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	srv, ranges := rangeServer(t, data)
+	fetcher := &migrations.RetryFetcher{
+		Fetcher:  NewHttpFetcher("/ipns/dist.example.com", srv.URL, "", 0),
+		MaxTries: 3,
+	}
+
+	// the partial download is of a different file
+	part := partialFile(t, fetcher, "kubo/v0.36.0/kubo.tar.gz")
+	err := os.WriteFile(part, bytes.Repeat([]byte("x"), 1000), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := sha512.Sum512(data)
+	dest := filepath.Join(t.TempDir(), "kubo.tar.gz")
+	_, err = DownloadFile(context.Background(), fetcher, "kubo/v0.36.0/kubo.tar.gz", dest, hex.EncodeToString(expected[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*ranges) != 2 || (*ranges)[0] == "" || (*ranges)[1] != "" {
+		t.Errorf("expected a resumed then a full download, got %q", *ranges)
+	}
+
+	out, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Error("download is corrupt")
+	}
+}
+
+func TestDownloadFileNoResumeWithoutDigest(t *testing.T) {
+	t.Setenv("IPFS_PATH", t.TempDir())
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	srv, ranges := rangeServer(t, data)
+	fetcher := NewHttpFetcher("/ipns/dist.example.com", srv.URL, "", 0)
+
+	part := partialFile(t, fetcher, "kubo/v0.36.0/kubo.tar.gz")
+	err := os.WriteFile(part, bytes.Repeat([]byte("x"), 1000), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "kubo.tar.gz")
+	_, err = DownloadFile(context.Background(), fetcher, "kubo/v0.36.0/kubo.tar.gz", dest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*ranges) != 1 || (*ranges)[0] != "" {
+		t.Errorf("expected a full download, got %q", *ranges)
+	}
+	out, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Error("download is corrupt")
+	}
+}
+
+func TestPartialDownloadLocked(t *testing.T) {
+	t.Setenv("IPFS_PATH", t.TempDir())
+	fetcher := memFetcher{"kubo/versions": []byte("v0.36.0\n")}
+
+	held, err := openPartial(context.Background(), fetcher, "kubo/versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	err = os.WriteFile(held.path, []byte("being downloaded"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "versions")
+	_, err = DownloadFile(context.Background(), fetcher, "kubo/versions", dest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.ReadFile(held.path)
+	if err != nil || string(out) != "being downloaded" {
+		t.Errorf("locked partial download was touched: %q, %v", out, err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(held.path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			t.Errorf("private partial download %s was not removed", e.Name())
+		}
+	}
+}
+
+func TestPartialDownloadRoot(t *testing.T) {
+	t.Setenv("IPFS_PATH", t.TempDir())
+	a := NewHttpFetcher("/ipfs/QmA", "http://gateway.example", "", 0)
+	b := NewHttpFetcher("/ipfs/QmB", "http://gateway.example", "", 0)
+	if partialFile(t, a, "kubo/versions") == partialFile(t, b, "kubo/versions") {
+		t.Error("partial downloads from different dist roots should differ")
+	}
+}
+
+func TestRangeStart(t *testing.T) {
+	start, err := rangeStart("bytes 1000-1999/2000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start != 1000 {
+		t.Errorf("expected 1000, got %d", start)
+	}
+
+	for _, s := range []string{"", "bytes */2000", "items 1-2/3"} {
+		if _, err := rangeStart(s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+}
+
+// testRelease returns the files of a release of kubo holding bin, with a
+// dist.json listing the archive digest, or digest if it is not empty.
+func testRelease(t *testing.T, vers string, bin []byte, digest string) memFetcher {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	err := tw.WriteHeader(&tar.Header{Name: "kubo/ipfs", Mode: 0o755, Size: int64(len(bin))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(bin)
+	tw.Close()
+	gz.Close()
+
+	if digest == "" {
+		sum := sha512.Sum512(buf.Bytes())
+		digest = hex.EncodeToString(sum[:])
+	}
+	info := DistInfo{
+		Version: vers,
+		Platforms: map[string]DistPlatform{
+			runtime.GOOS: {Archs: map[string]DistArtifact{
+				runtime.GOARCH: {SHA512: digest},
+			}},
+		},
+	}
+	distJSON, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arc := "kubo/" + vers + "/kubo_" + vers + "_" + runtime.GOOS + "-" + runtime.GOARCH + ".tar.gz"
+	return memFetcher{
+		arc:                           buf.Bytes(),
+		"kubo/" + vers + "/dist.json": distJSON,
+	}
+}
+
+func TestFetchBinary(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("releases are zip archives on windows")
+	}
+	t.Setenv("IPFS_PATH", t.TempDir())
+
+	bin := []byte("#!/bin/sh\necho 0.36.0\n")
+	fetcher := testRelease(t, "v0.36.0", bin, "")
+
+	out, err := FetchBinary(context.Background(), fetcher, "kubo", "v0.36.0", "ipfs", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, bin) {
+		t.Errorf("unexpected binary %q", got)
+	}
+	if filepath.Base(out) != "ipfs" {
+		t.Errorf("unexpected binary name %s", out)
+	}
+
+	_, err = FetchBinary(context.Background(), fetcher, "kubo", "v0.36.0", "ipfs", out)
+	if !errors.Is(err, os.ErrExist) {
+		t.Errorf("expected an existing binary not to be overwritten, got %v", err)
+	}
+}
+
+func TestFetchBinaryDigestMismatch(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("releases are zip archives on windows")
+	}
+	t.Setenv("IPFS_PATH", t.TempDir())
+
+	fetcher := testRelease(t, "v0.36.0", []byte("ipfs"), "deadbeef")
+
+	out := filepath.Join(t.TempDir(), "ipfs")
+	_, err := FetchBinary(context.Background(), fetcher, "kubo", "v0.36.0", "ipfs", out)
+	if err == nil {
+		t.Fatal("expected a digest mismatch")
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Error("binary should not have been unpacked")
+	}
+}
+
+func TestFetchBinaryFor(t *testing.T) {
+	t.Setenv("IPFS_PATH", t.TempDir())
+
+	bin := []byte("MZ")
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("kubo/ipfs.exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(bin)
+	zw.Close()
+
+	sum := sha512.Sum512(buf.Bytes())
+	info := DistInfo{Platforms: map[string]DistPlatform{
+		"windows": {Archs: map[string]DistArtifact{"arm64": {SHA512: hex.EncodeToString(sum[:])}}},
+	}}
+	distJSON, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetcher := memFetcher{
+		"kubo/v0.36.0/kubo_v0.36.0_windows-arm64.zip": buf.Bytes(),
+		"kubo/v0.36.0/dist.json":                      distJSON,
+	}
+
+	out, digest, source, err := FetchBinaryFor(context.Background(), TrackSource("mirror", fetcher), "kubo", "v0.36.0", "ipfs", t.TempDir(), Platform{OS: "windows", Arch: "arm64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != "sha512:"+hex.EncodeToString(sum[:]) {
+		t.Errorf("expected the digest of the archive, got %s", digest)
+	}
+	if source != "mirror" {
+		t.Errorf("expected source mirror, got %q", source)
+	}
+	if filepath.Base(out) != "ipfs.exe" {
+		t.Errorf("unexpected binary name %s", out)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, bin) {
+		t.Errorf("unexpected binary %q", got)
+	}
+}
+
+func TestDistInfoBuilds(t *testing.T) {
+	info := DistInfo{Platforms: map[string]DistPlatform{
+		"windows": {Archs: map[string]DistArtifact{"amd64": {}}},
+		"linux":   {Archs: map[string]DistArtifact{"arm64": {}, "amd64": {}}},
+	}}
+	builds := fmt.Sprint(info.Builds())
+	if builds != "[linux-amd64 linux-arm64 windows-amd64]" {
+		t.Errorf("unexpected builds %s", builds)
+	}
+}
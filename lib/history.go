@@ -0,0 +1,225 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+
+	"github.com/ipfs/kubo/repo/fsrepo/migrations"
+	"github.com/whyrusleeping/stump"
+)
+
+// historyFile is the name of the append-only log of updates in the ipfs
+// directory, holding one JSON encoded HistoryEntry per line.
+const historyFile = "update-history.log"
+
+// HistoryEntry records an action taken by ipfs-update.
+type HistoryEntry struct {
+	Time time.Time `json:"time"`
+	// Action is one of install, fetch, stash, revert and migrate.
+	Action string `json:"action"`
+	User   string `json:"user"`
+	// From and To are the versions involved, or the repo versions for
+	// migrations.
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	// Source is the fetcher the binary was downloaded from.
+	Source string `json:"source,omitempty"`
+	// Digest is the digest of the archive installed or fetched, as
+	// "sha512:<hex>", or of the binary reverted to, as "sha256:<hex>".
+	Digest   string        `json:"digest,omitempty"`
+	Duration time.Duration `json:"duration_ns"`
+	Success  bool          `json:"success"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// RecordHistory appends e to the history log, filling in the time, the user
+// and the outcome from err. Failing to record is logged, not fatal.
+func RecordHistory(e HistoryEntry, err error) {
+	e.Time = time.Now()
+	e.User = currentUser()
+	e.Success = err == nil
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	err = appendHistory(e)
+	if err != nil {
+		stump.VLog("could not record history: %s", err)
+	}
+}
+
+func appendHistory(e HistoryEntry) error {
+	ipfsDir, err := migrations.CheckIpfsDir("")
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(ipfsDir, historyFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadHistory returns the entries of the history log, oldest first.
+func ReadHistory() ([]HistoryEntry, error) {
+	ipfsDir, err := migrations.CheckIpfsDir("")
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(ipfsDir, historyFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseHistory(f)
+}
+
+func parseHistory(r io.Reader) ([]HistoryEntry, error) {
+	var entries []HistoryEntry
+	scan := bufio.NewScanner(r)
+	for n := 1; scan.Scan(); n++ {
+		if len(scan.Bytes()) == 0 {
+			continue
+		}
+		var e HistoryEntry
+		err := json.Unmarshal(scan.Bytes(), &e)
+		if err != nil {
+			return nil, fmt.Errorf("bad history entry on line %d: %s", n, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scan.Err()
+}
+
+// currentUser returns the user running ipfs-update. Under sudo, that is the
+// user who ran sudo, not root.
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return invokingUser(u.Username, u.Uid, os.Getenv("SUDO_USER"))
+	}
+	if u := os.Getenv("USER"); u != "" {
+		return u
+	}
+	return "unknown"
+}
+
+// invokingUser returns sudoUser if the user named name with uid is root and
+// sudoUser is set, and name otherwise.
+func invokingUser(name, uid, sudoUser string) string {
+	if uid == "0" && sudoUser != "" {
+		return sudoUser
+	}
+	return name
+}
+
+// FileDigest returns the sha256 digest of the file at path, in the form
+// "sha256:<hex>".
+func FileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sourceKey is the context key of the string that tracked fetchers record
+// their name in, see withSource.
+type sourceKey struct{}
+
+// withSource returns a context under which a successful fetch from a tracked
+// fetcher records the name of that fetcher in src.
+func withSource(ctx context.Context, src *string) context.Context {
+	return context.WithValue(ctx, sourceKey{}, src)
+}
+
+// recordSource records name as the source of the fetch made under ctx, if
+// ctx tracks it.
+func recordSource(ctx context.Context, name string) {
+	if src, ok := ctx.Value(sourceKey{}).(*string); ok {
+		*src = name
+	}
+}
+
+// TrackSource wraps f so that successful fetches are attributed to name in
+// the history log.
+func TrackSource(name string, f migrations.Fetcher) migrations.Fetcher {
+	return &sourceFetcher{Fetcher: f, name: name}
+}
+
+type sourceFetcher struct {
+	migrations.Fetcher
+	name string
+}
+
+func (f *sourceFetcher) Fetch(ctx context.Context, path string) ([]byte, error) {
+	data, err := f.Fetcher.Fetch(ctx, path)
+	if err == nil {
+		recordSource(ctx, f.name)
+	}
+	return data, err
+}
+
+func (f *sourceFetcher) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	rc, err := openFile(ctx, f.Fetcher, path)
+	if err != nil {
+		return nil, err
+	}
+	return &sourceReader{ReadCloser: rc, ctx: ctx, name: f.name}, nil
+}
+
+func (f *sourceFetcher) OpenAt(ctx context.Context, path string, offset int64) (io.ReadCloser, int64, error) {
+	rc, start, err := openFileAt(ctx, f.Fetcher, path, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &sourceReader{ReadCloser: rc, ctx: ctx, name: f.name}, start, nil
+}
+
+// sourceReader attributes a stream to its fetcher once it was read to the
+// end, as streams that are abandoned half way did not serve the file.
+type sourceReader struct {
+	io.ReadCloser
+	ctx  context.Context
+	name string
+}
+
+func (r *sourceReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		recordSource(r.ctx, r.name)
+	}
+	return n, err
+}
@@ -0,0 +1,43 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseHistory(t *testing.T) {
+	log := `{"time":"2024-05-10T12:00:00Z","action":"install","user":"alice","from":"v0.35.0","to":"v0.36.0","source":"https://ipfs.io","digest":"sha256:00","duration_ns":1000,"success":true}
+
+{"time":"2024-05-11T12:00:00Z","action":"revert","user":"bob","from":"v0.36.0","to":"v0.35.0","duration_ns":0,"success":false,"error":"boom"}
+`
+	entries, err := parseHistory(strings.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if e := entries[0]; e.Action != "install" || e.User != "alice" || e.Source != "https://ipfs.io" || !e.Success {
+		t.Errorf("unexpected first entry %+v", e)
+	}
+	if e := entries[1]; e.Action != "revert" || e.Success || e.Error != "boom" {
+		t.Errorf("unexpected second entry %+v", e)
+	}
+
+	_, err = parseHistory(strings.NewReader("{\n"))
+	if err == nil {
+		t.Error("expected error parsing truncated entry")
+	}
+}
+
+func TestInvokingUser(t *testing.T) {
+	if u := invokingUser("root", "0", "alice"); u != "alice" {
+		t.Errorf("expected the sudo user, got %s", u)
+	}
+	if u := invokingUser("root", "0", ""); u != "root" {
+		t.Errorf("expected root without sudo, got %s", u)
+	}
+	if u := invokingUser("bob", "1000", "alice"); u != "bob" {
+		t.Errorf("expected the user itself when not root, got %s", u)
+	}
+}
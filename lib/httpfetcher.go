@@ -0,0 +1,194 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/kubo/repo/fsrepo/migrations"
+	"github.com/whyrusleeping/stump"
+)
+
+const defaultGatewayURL = "https://ipfs.io"
+
+// HttpFetcher fetches files over HTTP from an ipfs gateway. It works like
+// the fetcher of the same name in the migrations package, but reports
+// progress and limits its rate as configured by its Transfers.
+type HttpFetcher struct {
+	Transfers
+
+	// Root, if set, is the root of the distribution site, used instead of
+	// the dist path the fetcher was created with.
+	Root *DistRoot
+
+	distPath  string
+	gateway   string
+	limit     int64
+	userAgent string
+}
+
+// NewHttpFetcher creates a new HttpFetcher
+//
+// Specifying "" for distPath sets the default IPNS path.
+// Specifying "" for gateway sets the default.
+// Specifying 0 for fetchLimit sets the default, -1 means no limit.
+func NewHttpFetcher(distPath, gateway, userAgent string, fetchLimit int64) *HttpFetcher {
+	f := &HttpFetcher{
+		distPath:  migrations.LatestIpfsDist,
+		gateway:   defaultGatewayURL,
+		limit:     defaultFetchLimit,
+		userAgent: userAgent,
+	}
+
+	if distPath != "" {
+		if !strings.HasPrefix(distPath, "/") {
+			distPath = "/" + distPath
+		}
+		f.distPath = distPath
+	}
+
+	if gateway != "" {
+		f.gateway = strings.TrimRight(gateway, "/")
+	}
+
+	if fetchLimit != 0 {
+		if fetchLimit < 0 {
+			fetchLimit = 0
+		}
+		f.limit = fetchLimit
+	}
+
+	return f
+}
+
+// Fetch attempts to fetch the file at the given path, from the distribution
+// site configured for this HttpFetcher.
+func (f *HttpFetcher) Fetch(ctx context.Context, filePath string) ([]byte, error) {
+	rc, err := f.Open(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	if f.limit != 0 {
+		return io.ReadAll(io.LimitReader(rc, f.limit))
+	}
+	return io.ReadAll(rc)
+}
+
+// Open starts fetching the file at the given path, from the distribution
+// site configured for this HttpFetcher. The caller must close the returned
+// reader.
+func (f *HttpFetcher) Open(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	rc, _, err := f.OpenAt(ctx, filePath, 0)
+	return rc, err
+}
+
+// OpenAt starts fetching the file at the given path from offset, using a range
+// request. If the gateway does not support range requests, the file is
+// fetched from the start, and the returned offset is 0.
+func (f *HttpFetcher) OpenAt(ctx context.Context, filePath string, offset int64) (io.ReadCloser, int64, error) {
+	gwURL := f.gateway + path.Join(f.dist(ctx), filePath)
+	stump.VLog("fetching with HTTP: %q", gwURL)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gwURL, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("http.NewRequest error: %s", err)
+	}
+
+	if f.userAgent != "" {
+		req.Header.Set("User-Agent", f.userAgent)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("http.DefaultClient.Do error: %s", err)
+	}
+
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// the partial download is not a prefix of the file, start over
+		resp.Body.Close()
+		return f.OpenAt(ctx, filePath, 0)
+	}
+
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		mes, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if err != nil {
+			return nil, 0, fmt.Errorf("error reading error body: %s", err)
+		}
+		return nil, 0, fmt.Errorf("GET %s error: %s: %s", gwURL, resp.Status, string(mes))
+	}
+
+	start := int64(0)
+	if resp.StatusCode == http.StatusPartialContent {
+		start, err = rangeStart(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("GET %s: unexpected content range %q", gwURL, resp.Header.Get("Content-Range"))
+		}
+	}
+
+	return f.track(ctx, resp.Body, filePath, f.gateway, resp.ContentLength), start, nil
+}
+
+func (f *HttpFetcher) dist(ctx context.Context) string {
+	if f.Root != nil {
+		return f.Root.Path(ctx)
+	}
+	return f.distPath
+}
+
+// ResolvePath resolves p with the gateway, which reports the CIDs of the
+// path it served in the X-Ipfs-Roots header.
+func (f *HttpFetcher) ResolvePath(ctx context.Context, p string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, f.gateway+p+"/", nil)
+	if err != nil {
+		return "", err
+	}
+	if f.userAgent != "" {
+		req.Header.Set("User-Agent", f.userAgent)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("HEAD %s error: %s", req.URL, resp.Status)
+	}
+
+	// the last root is the CID of the last segment of the path
+	roots := strings.Split(resp.Header.Get("X-Ipfs-Roots"), ",")
+	last := strings.TrimSpace(roots[len(roots)-1])
+	if last == "" {
+		return "", fmt.Errorf("gateway %s does not report the roots of %s", f.gateway, p)
+	}
+	return "/ipfs/" + last, nil
+}
+
+// rangeStart returns the first byte of a "bytes first-last/size" content
+// range.
+func rangeStart(contentRange string) (int64, error) {
+	spec, ok := strings.CutPrefix(contentRange, "bytes ")
+	if !ok {
+		return 0, fmt.Errorf("unsupported content range %q", contentRange)
+	}
+	first, _, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, fmt.Errorf("invalid content range %q", contentRange)
+	}
+	return strconv.ParseInt(first, 10, 64)
+}
+
+func (f *HttpFetcher) Close() error {
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/blang/semver/v4"
 	test "github.com/ipfs/ipfs-update/test-dist"
@@ -38,6 +39,7 @@ func NewInstall(target string, nocheck, downgrade bool, fetcher migrations.Fetch
 		downgrade:  downgrade,
 		binaryName: migrations.ExeName("ipfs"),
 		fetcher:    fetcher,
+		Policy:     defaultPolicy(),
 	}
 }
 
@@ -51,6 +53,8 @@ type Install struct {
 	installPath     string
 	stashedFromPath string
 	tmpBinPath      string
+	// set if there was no old binary to stash
+	noStash bool
 
 	noCheck   bool
 	downgrade bool
@@ -58,16 +62,66 @@ type Install struct {
 	// whether or not the install has succeeded
 	succeeded bool
 
+	// when the new binary started downloading, zero if the install was
+	// skipped before that
+	started time.Time
+	// how long repo migrations took
+	migrationTime time.Duration
+	// where the new binary was downloaded from, and the digest of its archive
+	source string
+	digest string
+
+	// journal of the install, nil until the new binary is downloaded
+	journ *Journal
+
 	fetcher migrations.Fetcher
+
+	// Checks selects the optional checks run against the new binary.
+	Checks test.Checks
+	// CheckInterop also checks the new binary against the installed one, see
+	// test.Checks.Interop.
+	CheckInterop bool
+
+	// Policy restricts the versions that may be installed.
+	Policy *Policy
+
+	// Pinner pins the downloaded archive into the local ipfs node, if not
+	// nil.
+	Pinner *Pinner
+	// Lock, if not nil, restricts the install to the archives it locks:
+	// those of the target version and of its repo migrations.
+	Lock *ReleaseLock
 }
 
+// Run downloads, verifies and installs the target version.
 func (i *Install) Run(ctx context.Context) error {
-	defer i.revertOnFailure()
+	ready, err := i.Prepare(ctx)
+	if err != nil || !ready {
+		return err
+	}
+	return i.Apply(ctx)
+}
+
+// Prepare checks that the target version may be installed, then downloads
+// and verifies it without touching the installed binary. It returns false if
+// the target version is already installed.
+func (i *Install) Prepare(ctx context.Context) (ready bool, err error) {
+	defer func() {
+		if err != nil {
+			i.finishJournal()
+			i.recordState()
+			i.recordHistory("install", err)
+		}
+	}()
+
+	err = checkNoJournal()
+	if err != nil {
+		return false, err
+	}
 
-	var err error
 	i.currentVers, err = CurrentIpfsVersion()
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	if i.currentVers == "none" {
@@ -75,59 +129,153 @@ func (i *Install) Run(ctx context.Context) error {
 	} else if i.currentVers == i.targetVers {
 		stump.Log("Already have version %s installed, skipping.", i.targetVers)
 		i.succeeded = true
-		return nil
+		return false, nil
 	} else if !i.downgrade {
 		semverCurrent, err := semver.ParseTolerant(i.currentVers)
 		if err != nil {
-			return err
+			return false, err
 		}
 		semverTarget, err := semver.ParseTolerant(i.targetVers)
 		if err != nil {
-			return err
+			return false, err
 		}
 		if semverTarget.LT(semverCurrent) {
-			return errors.New("in order to downgrade, please pass the --allow-downgrade flag or use \"revert\"")
+			return false, errors.New("in order to downgrade, please pass the --allow-downgrade flag or use \"revert\"")
+		}
+	}
+
+	err = i.Policy.Check(i.targetVers)
+	if err != nil {
+		return false, err
+	}
+	if i.currentVers != "none" {
+		err = i.Policy.CheckDowngrade(i.currentVers, i.targetVers)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if i.Lock != nil {
+		err = i.checkLockedMigrations()
+		if err != nil {
+			return false, err
 		}
 	}
 
+	i.started = time.Now()
 	err = i.downloadNewBinary(ctx)
 	if err != nil {
-		return err
+		return false, err
 	}
+	i.journal(PhaseDownloaded)
 
 	if !i.noCheck {
+		checks := i.Checks
+		if i.CheckInterop {
+			checks.Interop, err = InstalledBinary()
+			if err != nil {
+				return false, fmt.Errorf("cannot check interop: %s", err)
+			}
+		}
 		stump.Log("binary downloaded, verifying...")
-		err = test.TestBinary(i.tmpBinPath, i.targetVers)
+		err = test.TestBinary(ctx, i.tmpBinPath, i.targetVers, checks)
 		if err != nil {
-			return err
+			return false, err
 		}
 	} else {
 		stump.Log("skipping tests since '--no-check' was passed")
 	}
+	i.journal(PhaseVerified)
+
+	return true, nil
+}
+
+// Discard drops the binary downloaded by Prepare when it will not be
+// installed.
+func (i *Install) Discard() {
+	i.finishJournal()
+	removeTmpBinary(i.tmpBinPath)
+}
+
+// Suspend removes the journal of a prepared install, keeping the downloaded
+// binary, so that the update lock can be released until Resume. There is
+// nothing to recover before Apply starts.
+func (i *Install) Suspend() {
+	if i.journ == nil {
+		return
+	}
+	j := *i.journ
+	j.NewBinary = ""
+	j.clear()
+	i.journ = nil
+}
 
-	err = i.maybeStash()
+// Resume journals a suspended install again, once the update lock was taken
+// back. It fails if another update changed the installed version meanwhile.
+func (i *Install) Resume() error {
+	err := checkNoJournal()
 	if err != nil {
 		return err
 	}
-
-	err = i.selectGoodInstallLoc()
+	current, err := CurrentIpfsVersion()
 	if err != nil {
 		return err
 	}
+	if current != i.currentVers {
+		return fmt.Errorf("installed version changed from %s to %s while waiting", i.currentVers, current)
+	}
+	i.journal(PhaseVerified)
+	return nil
+}
 
-	stump.Log("installing new binary to %s", i.installPath)
-	err = InstallBinaryTo(i.tmpBinPath, i.installPath)
-	if err != nil {
-		// in case of error here, replace old binary
-		stump.Error("Install failed: ", err)
+// Apply installs the binary downloaded by Prepare in place of the current
+// one and migrates the repo. If anything fails, the previous binary is put
+// back.
+func (i *Install) Apply(ctx context.Context) error {
+	return i.apply(ctx, PhaseVerified)
+}
 
-		return err
+// apply runs the steps of Apply that come after phase done.
+func (i *Install) apply(ctx context.Context, done Phase) (err error) {
+	defer func() {
+		i.finishJournal()
+		i.recordState()
+		i.recordHistory("install", err)
+	}()
+	defer i.revertOnFailure()
+
+	if !done.reached(PhaseStashed) {
+		err = i.maybeStash(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = i.selectGoodInstallLoc()
+		if err != nil {
+			return err
+		}
+		i.journal(PhaseStashed)
 	}
 
-	err = i.postInstallMigrationCheck(ctx)
-	if err != nil {
-		stump.Error("Migration Failed: ", err)
-		return err
+	if !done.reached(PhaseInstalled) {
+		stump.Log("installing new binary to %s", i.installPath)
+		err = InstallBinaryTo(ctx, i.tmpBinPath, i.installPath)
+		if err != nil {
+			// in case of error here, replace old binary
+			stump.Error("Install failed: ", err)
+
+			return err
+		}
+		i.journal(PhaseInstalled)
+	}
+
+	if !done.reached(PhaseMigrated) {
+		err = i.postInstallMigrationCheck(ctx)
+		if err != nil {
+			stump.Error("Migration Failed: ", err)
+			return err
+		}
+		i.journal(PhaseMigrated)
 	}
 
 	i.succeeded = true
@@ -146,15 +294,66 @@ func (i *Install) revertOnFailure() {
 	}
 }
 
-func (i *Install) maybeStash() error {
+// Revert undoes a successful Apply, putting the previous binary back and
+// migrating the repo back to the version it requires.
+func (i *Install) Revert(ctx context.Context) error {
+	if i.currentVers == "none" || i.installPath == "" {
+		return errors.New("no previous installation to revert to")
+	}
+
+	stump.Log("reverting to %s", i.currentVers)
+	i.succeeded = false
+	defer i.recordState()
+
+	// rolling back must not be interrupted
+	ctx = context.WithoutCancel(ctx)
+
+	start := time.Now()
+	revertOldBinary(i.installPath, i.currentVers)
+
+	var err error
+	if !util.BeforeVersion("v0.3.10", i.currentVers) {
+		_, err = checkMigration(ctx, i.migrationFetcher(), i.installPath)
+		if err != nil {
+			err = fmt.Errorf("failed to migrate repo back: %s", err)
+		}
+	}
+
+	RecordHistory(HistoryEntry{
+		Action:   "revert",
+		From:     i.targetVers,
+		To:       i.currentVers,
+		Duration: time.Since(start),
+	}, err)
+	return err
+}
+
+// recordHistory records the outcome of the install in the history log.
+func (i *Install) recordHistory(action string, err error) {
+	var d time.Duration
+	if !i.started.IsZero() {
+		d = time.Since(i.started)
+	}
+	RecordHistory(HistoryEntry{
+		Action:   action,
+		From:     i.currentVers,
+		To:       i.targetVers,
+		Source:   i.source,
+		Digest:   i.digest,
+		Duration: d,
+	}, err)
+}
+
+func (i *Install) maybeStash(ctx context.Context) error {
 	if i.currentVers != "none" {
 		stump.Log("stashing old binary")
-		oldpath, err := StashOldBinary(i.currentVers, false)
+		oldpath, err := StashOldBinary(ctx, i.currentVers, false)
 		if err != nil {
 			if strings.Contains(err.Error(), "could not find old") {
 				stump.Log("stash failed, no binary found.")
 				stump.Log("** this could be because you have a daemon running, but no ipfs binary in your path. **")
 				stump.Log("continuing anyways, but skipping stash")
+				i.noStash = true
 				return nil
 			}
 			return err
@@ -174,11 +373,13 @@ func (i *Install) postInstallMigrationCheck(ctx context.Context) error {
 		return nil
 	}
 
-	return checkMigration(ctx, i.fetcher, i.installPath)
+	var err error
+	i.migrationTime, err = checkMigration(ctx, i.migrationFetcher(), i.installPath)
+	return err
 }
 
-func InstallBinaryTo(nbin, nloc string) error {
-	err := util.CopyTo(nbin, nloc)
+func InstallBinaryTo(ctx context.Context, nbin, nloc string) error {
+	err := util.CopyTo(ctx, nbin, nloc)
 	if err != nil {
 		return fmt.Errorf("error moving new binary into place: %s", err)
 	}
@@ -193,7 +394,7 @@ func InstallBinaryTo(nbin, nloc string) error {
 
 // StashOldBinary moves the existing ipfs binary to a backup directory
 // and returns the path to the original location of the old binary
-func StashOldBinary(tag string, keep bool) (string, error) {
+func StashOldBinary(ctx context.Context, tag string, keep bool) (string, error) {
 	loc, err := exec.LookPath(migrations.ExeName("ipfs"))
 	if err != nil {
 		return "", fmt.Errorf("could not find old binary: %s", err)
@@ -229,7 +430,7 @@ func StashOldBinary(tag string, keep bool) (string, error) {
 	}
 
 	stump.VLog("  - moving %s to %s", loc, npath)
-	err = f(loc, npath)
+	err = f(ctx, loc, npath)
 	if err != nil {
 		return "", fmt.Errorf("could not move old binary: %s", err)
 	}
@@ -237,6 +438,34 @@ func StashOldBinary(tag string, keep bool) (string, error) {
 	return loc, nil
 }
 
+// InstalledBinary returns the path of the currently installed ipfs binary. If
+// there is none in the path, the binary stashed for the currently running
+// version is used instead.
+func InstalledBinary() (string, error) {
+	loc, err := exec.LookPath(migrations.ExeName("ipfs"))
+	if err == nil {
+		return filepath.Abs(loc)
+	}
+
+	vers, verr := CurrentIpfsVersion()
+	if verr != nil || vers == "none" {
+		return "", fmt.Errorf("could not find installed binary: %s", err)
+	}
+
+	ipfsdir, err := migrations.CheckIpfsDir("")
+	if err != nil {
+		return "", err
+	}
+
+	stashed := filepath.Join(ipfsdir, "old-bin", "ipfs-"+vers)
+	_, err = os.Stat(stashed)
+	if err != nil {
+		return "", fmt.Errorf("could not find installed or stashed binary for %s", vers)
+	}
+
+	return stashed, nil
+}
+
 func (i *Install) downloadNewBinary(ctx context.Context) error {
 	out, err := i.getTmpPath()
 	if err != nil {
@@ -246,14 +475,44 @@ func (i *Install) downloadNewBinary(ctx context.Context) error {
 	distname := "kubo"
 	stump.Log("fetching %s version %s", distname, i.targetVers)
 
-	i.tmpBinPath, err = migrations.FetchBinary(ctx, i.fetcher, distname, i.targetVers, "ipfs", out)
+	var opts fetchOptions
+	if i.Pinner != nil {
+		opts.keep = i.Pinner.keep
+	}
+	if i.Lock != nil {
+		a, err := i.Lock.Archive(runtime.GOOS, runtime.GOARCH)
+		if err != nil {
+			return err
+		}
+		opts.artifact = &DistArtifact{CID: a.CID, SHA512: a.SHA512}
+	}
+	i.tmpBinPath, i.digest, i.source, err = fetchBinary(ctx, i.fetcher, distname, i.targetVers, "ipfs", out, opts)
 	if err != nil {
 		return fmt.Errorf("failed to get ipfs binary: %s", err)
 	}
-
 	return nil
 }
 
+// checkLockedMigrations checks that the lock covers the migrations of the
+// local repo, if there is one.
+func (i *Install) checkLockedMigrations() error {
+	repo, err := migrations.RepoVersion("")
+	if err != nil {
+		stump.VLog("not checking locked migrations, no repo: %s", err)
+		return nil
+	}
+	return i.Lock.CheckMigrations(repo, runtime.GOOS, runtime.GOARCH)
+}
+
+// migrationFetcher returns the fetcher of repo migrations, restricted to the
+// locked ones if the install is locked.
+func (i *Install) migrationFetcher() migrations.Fetcher {
+	if i.Lock != nil {
+		return i.Lock.Fetcher(i.fetcher)
+	}
+	return i.fetcher
+}
+
 func (i *Install) selectGoodInstallLoc() error {
 	var installDir string
 	if i.stashedFromPath != "" {
@@ -2,8 +2,12 @@ package lib
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"path"
 	"strings"
 	"time"
@@ -14,11 +18,28 @@ import (
 )
 
 const (
-	shellUpTimeout    = 2 * time.Second
-	defaultFetchLimit = 1024 * 1024 * 512
+	shellUpTimeout       = 2 * time.Second
+	remoteShellUpTimeout = 10 * time.Second
+	defaultFetchLimit    = 1024 * 1024 * 512
 )
 
+// IpfsFetcher fetches files through the RPC api of an ipfs node, by default
+// the local one.
 type IpfsFetcher struct {
+	Transfers
+
+	// ApiAddr, if set, is the address of the RPC api of another node to fetch
+	// through, as a multiaddr or an http(s) URL.
+	ApiAddr string
+	// ApiAuth is the secret to authenticate with to ApiAddr, in the form
+	// used by the API.Authorizations setting of kubo: "basic:user:password"
+	// or "bearer:token".
+	ApiAuth string
+
+	// Root, if set, is the root of the distribution site, used instead of
+	// the dist path the fetcher was created with.
+	Root *DistRoot
+
 	distPath string
 	limit    int64
 }
@@ -51,31 +72,91 @@ func NewIpfsFetcher(distPath string, fetchLimit int64) *IpfsFetcher {
 }
 
 // Fetch attempts to fetch the file at the given path, from the distribution
-// site configured for this HttpFetcher.  Returns io.ReadCloser on success,
-// which caller must close.
+// site configured for this IpfsFetcher.
 func (f *IpfsFetcher) Fetch(ctx context.Context, filePath string) ([]byte, error) {
-	sh, _, err := ApiShell("")
+	rc, err := f.Open(ctx, filePath)
 	if err != nil {
 		return nil, err
 	}
+	defer rc.Close()
+
+	if f.limit != 0 {
+		return io.ReadAll(io.LimitReader(rc, f.limit))
+	}
+	return io.ReadAll(rc)
+}
 
-	resp, err := sh.Request("cat", path.Join(f.distPath, filePath)).Send(ctx)
+// Open starts fetching the file at the given path, from the distribution
+// site configured for this IpfsFetcher. The caller must close the returned
+// reader.
+func (f *IpfsFetcher) Open(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	rc, _, err := f.OpenAt(ctx, filePath, 0)
+	return rc, err
+}
+
+// OpenAt starts fetching the file at the given path from offset.
+func (f *IpfsFetcher) OpenAt(ctx context.Context, filePath string, offset int64) (io.ReadCloser, int64, error) {
+	sh, err := f.shell()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+
+	req := sh.Request("cat", path.Join(f.dist(ctx), filePath))
+	if offset > 0 {
+		req.Option("offset", offset)
+	}
+	resp, err := req.Send(ctx)
+	if err != nil {
+		return nil, 0, err
 	}
 	if resp.Error != nil {
-		return nil, resp.Error
+		return nil, 0, resp.Error
 	}
 
-	var rc io.ReadCloser
-	if f.limit != 0 {
-		rc = migrations.NewLimitReadCloser(resp.Output, f.limit)
+	return f.track(ctx, resp.Output, filePath, f.Source(), -1), offset, nil
+}
+
+func (f *IpfsFetcher) dist(ctx context.Context) string {
+	if f.Root != nil {
+		return f.Root.Path(ctx)
+	}
+	return f.distPath
+}
+
+// ResolvePath resolves p through the node.
+func (f *IpfsFetcher) ResolvePath(ctx context.Context, p string) (string, error) {
+	sh, err := f.shell()
+	if err != nil {
+		return "", err
+	}
+
+	var out struct {
+		Path string
+	}
+	err = sh.Request("resolve", p).Option("recursive", true).Exec(ctx, &out)
+	if err != nil {
+		return "", err
+	}
+	return out.Path, nil
+}
+
+func (f *IpfsFetcher) shell() (*api.Shell, error) {
+	var sh *api.Shell
+	var err error
+	if f.ApiAddr != "" {
+		sh, _, err = RemoteShell(f.ApiAddr, f.ApiAuth)
 	} else {
-		rc = resp.Output
+		sh, _, err = ApiShell("")
 	}
-	defer rc.Close()
+	return sh, err
+}
 
-	return io.ReadAll(rc)
+// Source describes the node the fetcher fetches through.
+func (f *IpfsFetcher) Source() string {
+	if f.ApiAddr != "" {
+		return "ipfs node at " + f.ApiAddr
+	}
+	return "local ipfs node"
 }
 
 // ApiShell creates a new ipfs api shell and checks that it is up.  If the shell
@@ -85,7 +166,10 @@ func ApiShell(ipfsDir string) (*api.Shell, string, error) {
 	if err != nil {
 		return nil, "", err
 	}
-	sh := api.NewShell(apiEp)
+	sh, err := newShell(apiEp, "")
+	if err != nil {
+		return nil, "", err
+	}
 	sh.SetTimeout(shellUpTimeout)
 	ver, _, err := sh.Version()
 	if err != nil {
@@ -95,6 +179,79 @@ func ApiShell(ipfsDir string) (*api.Shell, string, error) {
 	return sh, ver, nil
 }
 
+// RemoteShell creates an api shell for the ipfs RPC api at addr, a multiaddr
+// or an http(s) URL, and checks that it is up. If auth is not empty, requests
+// are authenticated with it, see IpfsFetcher.ApiAuth.
+func RemoteShell(addr, auth string) (*api.Shell, string, error) {
+	a, err := util.ParseApiAddr(addr)
+	if err != nil {
+		return nil, "", err
+	}
+	sh, err := newShell(a, auth)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sh.SetTimeout(remoteShellUpTimeout)
+	ver, _, err := sh.Version()
+	if err != nil {
+		return nil, "", fmt.Errorf("ipfs api at %s is not reachable: %s", a, err)
+	}
+	sh.SetTimeout(0)
+	return sh, ver, nil
+}
+
+// newShell creates an api shell for the api at a, authenticating with auth
+// if it is not empty.
+func newShell(a util.ApiAddr, auth string) (*api.Shell, error) {
+	tpt := a.Transport()
+	var rt http.RoundTripper = tpt
+	if auth != "" {
+		header, err := apiAuthHeader(auth)
+		if err != nil {
+			return nil, err
+		}
+		u, err := url.Parse(a.URL())
+		if err != nil {
+			return nil, err
+		}
+		rt = &authTransport{rt: tpt, host: u.Host, header: header}
+	}
+	return api.NewShellWithClient(a.URL(), &http.Client{Transport: rt}), nil
+}
+
+// apiAuthHeader converts an api secret in the form kubo uses for
+// API.Authorizations into an Authorization header.
+func apiAuthHeader(secret string) (string, error) {
+	if token, ok := strings.CutPrefix(secret, "bearer:"); ok {
+		return "Bearer " + token, nil
+	}
+	if cred, ok := strings.CutPrefix(secret, "basic:"); ok {
+		if strings.Contains(cred, ":") {
+			cred = base64.StdEncoding.EncodeToString([]byte(cred))
+		}
+		return "Basic " + cred, nil
+	}
+	return "", errors.New(`api auth must be "basic:user:password" or "bearer:token"`)
+}
+
+// authTransport adds an Authorization header to requests to the api host, so
+// that the secret is not sent to other hosts if a request is redirected.
+type authTransport struct {
+	rt     http.RoundTripper
+	host   string
+	header string
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.host {
+		return t.rt.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", t.header)
+	return t.rt.RoundTrip(req)
+}
+
 func (f *IpfsFetcher) Close() error {
 	return nil
 }
@@ -0,0 +1,208 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestApiAuthHeader(t *testing.T) {
+	cases := map[string]string{
+		"bearer:s3cret":          "Bearer s3cret",
+		"basic:alice:pa:ss":      "Basic YWxpY2U6cGE6c3M=",
+		"basic:YWxpY2U6cGE6c3M=": "Basic YWxpY2U6cGE6c3M=",
+	}
+	for secret, expected := range cases {
+		got, err := apiAuthHeader(secret)
+		if err != nil {
+			t.Errorf("apiAuthHeader(%q): %s", secret, err)
+			continue
+		}
+		if got != expected {
+			t.Errorf("apiAuthHeader(%q): expected %q, got %q", secret, expected, got)
+		}
+	}
+
+	if _, err := apiAuthHeader("s3cret"); err == nil {
+		t.Error("expected an error for a secret without a scheme")
+	}
+}
+
+func TestAuthTransportOtherHost(t *testing.T) {
+	var got []string
+	rt := &authTransport{
+		rt: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			got = append(got, req.Header.Get("Authorization"))
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+		host:   "node.internal:5001",
+		header: "Bearer s3cret",
+	}
+	for _, u := range []string{"http://node.internal:5001/api/v0/version", "http://elsewhere.example/api/v0/version"} {
+		req, err := http.NewRequest(http.MethodPost, u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != 2 || got[0] != "Bearer s3cret" || got[1] != "" {
+		t.Errorf("expected the secret to be sent to the api host only, got %q", got)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// rpcHandler serves the version, cat and resolve commands of the ipfs RPC
+// api, if the request carries the given Authorization header. Only
+// /ipns/dist.example resolves.
+func rpcHandler(auth string, files map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != auth {
+			http.Error(w, "403 - Forbidden", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v0/version":
+			json.NewEncoder(w).Encode(map[string]string{"Version": "0.36.0"})
+		case "/api/v0/cat":
+			data, ok := files[r.URL.Query().Get("arg")]
+			if !ok {
+				w.Header().Set("Content-Type", "text/plain")
+				http.Error(w, "no link named", http.StatusInternalServerError)
+				return
+			}
+			io.WriteString(w, data)
+		case "/api/v0/resolve":
+			if r.URL.Query().Get("arg") != "/ipns/dist.example" {
+				w.Header().Set("Content-Type", "text/plain")
+				http.Error(w, "could not resolve name", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"Path": "/ipfs/QmDist"})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func TestIpfsFetcherRemote(t *testing.T) {
+	files := map[string]string{"/ipfs/QmDist/kubo/versions": "v0.36.0\n"}
+	srv := httptest.NewServer(rpcHandler("Bearer s3cret", files))
+	defer srv.Close()
+
+	f := NewIpfsFetcher("/ipfs/QmDist", 0)
+	f.ApiAddr = srv.URL
+	f.ApiAuth = "bearer:s3cret"
+	data, err := f.Fetch(context.Background(), "kubo/versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "v0.36.0\n" {
+		t.Errorf("unexpected data %q", data)
+	}
+	if !strings.Contains(f.Source(), srv.URL) {
+		t.Errorf("unexpected source %q", f.Source())
+	}
+
+	f.ApiAuth = "bearer:wrong"
+	_, err = f.Fetch(context.Background(), "kubo/versions")
+	if err == nil {
+		t.Error("expected an error with the wrong secret")
+	}
+}
+
+func TestIpfsFetcherResolvePath(t *testing.T) {
+	files := map[string]string{"/ipfs/QmDist/kubo/versions": "v0.36.0\n"}
+	srv := httptest.NewServer(rpcHandler("", files))
+	defer srv.Close()
+
+	f := NewIpfsFetcher("/ipns/dist.example", 0)
+	f.ApiAddr = srv.URL
+	f.Root = NewDistRoot("/ipns/dist.example", f)
+	data, err := f.Fetch(context.Background(), "kubo/versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "v0.36.0\n" {
+		t.Errorf("unexpected data %q", data)
+	}
+
+	_, err = f.ResolvePath(context.Background(), "/ipns/missing.example")
+	if err == nil {
+		t.Error("expected an error for an unknown name")
+	}
+}
+
+func TestIpfsFetcherUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix sockets")
+	}
+
+	sock := filepath.Join(t.TempDir(), "api.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"/ipfs/QmDist/kubo/versions": "v0.36.0\n"}
+	srv := &http.Server{Handler: rpcHandler("", files)}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	f := NewIpfsFetcher("/ipfs/QmDist", 0)
+	f.ApiAddr = "/unix" + sock
+	data, err := f.Fetch(context.Background(), "kubo/versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "v0.36.0\n" {
+		t.Errorf("unexpected data %q", data)
+	}
+}
+
+func TestCurrentIpfsVersionUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix sockets")
+	}
+
+	ipfsDir := t.TempDir()
+	t.Setenv("IPFS_PATH", ipfsDir)
+	sock := filepath.Join(ipfsDir, "api.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: rpcHandler("", nil)}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	err = os.WriteFile(filepath.Join(ipfsDir, "api"), []byte("/unix"+sock), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ver, err := CurrentIpfsVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ver != "v0.36.0" {
+		t.Errorf("expected v0.36.0 from the daemon, got %s", ver)
+	}
+	if !daemonRunning() {
+		t.Error("expected the daemon to be detected")
+	}
+}
@@ -0,0 +1,328 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ipfs/ipfs-update/util"
+	"github.com/ipfs/kubo/repo/fsrepo/migrations"
+	"github.com/whyrusleeping/stump"
+)
+
+// journalFile is the name of the file in the ipfs directory tracking the
+// progress of an install, so that an interrupted one can be recovered.
+const journalFile = "update-journal.json"
+
+// Phase is a step of an install that has been completed.
+type Phase string
+
+// The phases of an install, in order.
+const (
+	PhaseDownloaded Phase = "downloaded"
+	// PhaseVerified means the new binary passed its checks, or they were
+	// skipped.
+	PhaseVerified  Phase = "verified"
+	PhaseStashed   Phase = "stashed"
+	PhaseInstalled Phase = "installed"
+	PhaseMigrated  Phase = "migrated"
+)
+
+var phaseOrder = []Phase{PhaseDownloaded, PhaseVerified, PhaseStashed, PhaseInstalled, PhaseMigrated}
+
+// reached reports whether phase p is at or after phase q.
+func (p Phase) reached(q Phase) bool {
+	pi, qi := -1, -1
+	for i, ph := range phaseOrder {
+		if ph == p {
+			pi = i
+		}
+		if ph == q {
+			qi = i
+		}
+	}
+	return pi >= qi
+}
+
+// Journal records the progress of an install.
+type Journal struct {
+	// From is the version being replaced, "none" if there is none.
+	From string `json:"from"`
+	To   string `json:"to"`
+	// NewBinary is where the new binary was downloaded to.
+	NewBinary string `json:"new_binary"`
+	// InstallPath is where the new binary is installed, once known.
+	InstallPath string `json:"install_path,omitempty"`
+	// NoStash is set if there was no old binary to stash, so that there is
+	// nothing to restore.
+	NoStash bool      `json:"no_stash,omitempty"`
+	Phase   Phase     `json:"phase"`
+	Started time.Time `json:"started"`
+	Updated time.Time `json:"updated"`
+}
+
+// LoadJournal reads the journal of an interrupted install. It returns nil if
+// there is none.
+func LoadJournal() (*Journal, error) {
+	ipfsDir, err := migrations.CheckIpfsDir("")
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(ipfsDir, journalFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	j := new(Journal)
+	err = json.Unmarshal(data, j)
+	if err != nil {
+		return nil, fmt.Errorf("invalid install journal: %s", err)
+	}
+	return j, nil
+}
+
+// save atomically replaces the journal on disk with j.
+func (j *Journal) save() error {
+	ipfsDir, err := migrations.CheckIpfsDir("")
+	if err != nil {
+		return err
+	}
+
+	j.Updated = time.Now()
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(ipfsDir, journalFile)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// clear removes the journal and the downloaded binary.
+func (j *Journal) clear() {
+	ipfsDir, err := migrations.CheckIpfsDir("")
+	if err == nil {
+		err = os.Remove(filepath.Join(ipfsDir, journalFile))
+	}
+	if err != nil && !os.IsNotExist(err) {
+		stump.Error("could not remove install journal: %s", err)
+	}
+
+	removeTmpBinary(j.NewBinary)
+}
+
+// removeTmpBinary removes the temporary directory a binary was downloaded
+// to.
+func removeTmpBinary(bin string) {
+	if bin == "" {
+		return
+	}
+	dir := filepath.Dir(bin)
+	if !strings.HasPrefix(filepath.Base(dir), "ipfs-update") {
+		return
+	}
+	err := os.RemoveAll(dir)
+	if err != nil {
+		stump.VLog("could not remove %s: %s", dir, err)
+	}
+}
+
+// journal records that the install completed phase p. Failing to write the
+// journal only loses the ability to recover, so it is logged, not fatal.
+func (i *Install) journal(p Phase) {
+	if i.journ == nil {
+		i.journ = &Journal{
+			From:      i.currentVers,
+			To:        i.targetVers,
+			NewBinary: i.tmpBinPath,
+			Started:   time.Now(),
+		}
+	}
+	i.journ.Phase = p
+	i.journ.InstallPath = i.installPath
+	i.journ.NoStash = i.noStash
+
+	err := i.journ.save()
+	if err != nil {
+		stump.Error("could not write install journal: %s", err)
+	}
+}
+
+// finishJournal removes the journal once the install has completed or has
+// been reverted.
+func (i *Install) finishJournal() {
+	if i.journ != nil {
+		i.journ.clear()
+		i.journ = nil
+	}
+}
+
+// checkNoJournal returns an error if an interrupted install needs to be
+// recovered first.
+func checkNoJournal() error {
+	j, err := LoadJournal()
+	if err != nil {
+		return err
+	}
+	if j != nil {
+		return fmt.Errorf("found an interrupted install of %s, run 'ipfs-update recover' first", j.To)
+	}
+	return nil
+}
+
+// Recover finishes the interrupted install recorded in journal j if the new
+// binary was verified and is still around, or rolls it back otherwise. If
+// rollback is set, it is always rolled back.
+func Recover(ctx context.Context, j *Journal, fetcher migrations.Fetcher, rollback bool) error {
+	if !rollback {
+		if !j.Phase.reached(PhaseVerified) {
+			stump.Log("new binary was not verified, rolling back")
+			rollback = true
+		} else if _, err := os.Stat(j.NewBinary); err != nil && !j.Phase.reached(PhaseInstalled) {
+			stump.Log("new binary is gone (%s), rolling back", err)
+			rollback = true
+		}
+	}
+
+	start := time.Now()
+	var err error
+	if rollback {
+		err = rollbackJournal(ctx, j, fetcher)
+	} else {
+		err = completeJournal(ctx, j, fetcher)
+	}
+
+	RecordHistory(HistoryEntry{
+		Action:   "recover",
+		From:     j.From,
+		To:       j.To,
+		Duration: time.Since(start),
+	}, err)
+	return err
+}
+
+func completeJournal(ctx context.Context, j *Journal, fetcher migrations.Fetcher) error {
+	stump.Log("completing install of %s from phase %q", j.To, j.Phase)
+
+	i := NewInstall(j.To, false, false, fetcher)
+	i.currentVers = j.From
+	i.tmpBinPath = j.NewBinary
+	i.installPath = j.InstallPath
+	i.noStash = j.NoStash
+	i.started = j.Started
+	i.journ = j
+
+	if !j.Phase.reached(PhaseStashed) {
+		// the old binary may already have been moved to the stash, install
+		// where it was rather than wherever stashing again would pick
+		ipfsDir, err := migrations.CheckIpfsDir("")
+		if err != nil {
+			return err
+		}
+		if oldPath := stashedFrom(ipfsDir, j); oldPath != "" {
+			i.stashedFromPath = filepath.Dir(oldPath)
+		}
+	}
+
+	return i.apply(ctx, j.Phase)
+}
+
+// stashedFrom returns the path the old binary was stashed from by the
+// install of j, or "" if it was not stashed yet. The stash may have been
+// interrupted before the install path was journaled, so only a path written
+// during this install is trusted.
+func stashedFrom(ipfsDir string, j *Journal) string {
+	pathOld := filepath.Join(ipfsDir, "old-bin", "path-old")
+	fi, err := os.Stat(pathOld)
+	if err != nil || fi.ModTime().Before(j.Started) {
+		return ""
+	}
+	data, err := os.ReadFile(pathOld)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func rollbackJournal(ctx context.Context, j *Journal, fetcher migrations.Fetcher) error {
+	stump.Log("rolling back install of %s from phase %q", j.To, j.Phase)
+
+	// rolling back must not be interrupted
+	ctx = context.WithoutCancel(ctx)
+
+	ipfsDir, err := migrations.CheckIpfsDir("")
+	if err != nil {
+		return err
+	}
+
+	if j.From == "none" || j.NoStash {
+		if j.NoStash {
+			stump.Log("no old binary was stashed, nothing to restore")
+		}
+		// nothing to restore, just remove what was installed
+		if j.Phase.reached(PhaseInstalled) && j.InstallPath != "" {
+			err = os.Remove(j.InstallPath)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("could not remove new binary: %s", err)
+			}
+		}
+		j.clear()
+		return nil
+	}
+
+	oldPath := j.InstallPath
+	if oldPath == "" {
+		oldPath = stashedFrom(ipfsDir, j)
+	}
+
+	// the stash is only complete once the stashed phase was reached, or the
+	// original binary was removed after copying it
+	stashed := filepath.Join(ipfsDir, "old-bin", "ipfs-"+j.From)
+	_, origErr := os.Stat(oldPath)
+	if oldPath != "" && (j.Phase.reached(PhaseStashed) || os.IsNotExist(origErr)) {
+		stump.Log("restoring %s to %s", stashed, oldPath)
+		err = InstallBinaryTo(ctx, stashed, oldPath)
+		if err != nil {
+			return fmt.Errorf("could not restore old binary: %s", err)
+		}
+		err = os.Remove(stashed)
+		if err != nil {
+			stump.VLog("could not remove stashed binary: %s", err)
+		}
+	}
+
+	if j.Phase.reached(PhaseInstalled) && oldPath != "" && !util.BeforeVersion("v0.3.10", j.From) {
+		// the repo may have been migrated, fully or partially
+		_, err = checkMigration(ctx, fetcher, oldPath)
+		if err != nil {
+			return fmt.Errorf("failed to migrate repo back: %s", err)
+		}
+	}
+
+	j.clear()
+	return nil
+}
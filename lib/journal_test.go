@@ -0,0 +1,183 @@
+package lib
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPhaseReached(t *testing.T) {
+	if !PhaseInstalled.reached(PhaseStashed) {
+		t.Error("installed should have reached stashed")
+	}
+	if !PhaseStashed.reached(PhaseStashed) {
+		t.Error("stashed should have reached itself")
+	}
+	if PhaseVerified.reached(PhaseStashed) {
+		t.Error("verified should not have reached stashed")
+	}
+	if Phase("bogus").reached(PhaseDownloaded) {
+		t.Error("unknown phase should not have reached anything")
+	}
+}
+
+func TestJournalRoundTrip(t *testing.T) {
+	t.Setenv("IPFS_PATH", t.TempDir())
+
+	j, err := LoadJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j != nil {
+		t.Fatal("expected no journal")
+	}
+
+	i := &Install{currentVers: "v0.35.0", targetVers: "v0.36.0", tmpBinPath: "/nonexistent/ipfs-new"}
+	i.journal(PhaseVerified)
+
+	j, err = LoadJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j == nil || j.From != "v0.35.0" || j.To != "v0.36.0" || j.Phase != PhaseVerified {
+		t.Fatalf("unexpected journal %+v", j)
+	}
+	if checkNoJournal() == nil {
+		t.Error("expected interrupted install to be reported")
+	}
+
+	i.finishJournal()
+	if checkNoJournal() != nil {
+		t.Error("expected journal to be removed")
+	}
+}
+
+func TestRollbackStashed(t *testing.T) {
+	ipfsDir := t.TempDir()
+	t.Setenv("IPFS_PATH", ipfsDir)
+
+	// the install was interrupted after stashing the old binary
+	binDir := t.TempDir()
+	installPath := filepath.Join(binDir, "ipfs")
+	oldBin := filepath.Join(ipfsDir, "old-bin")
+	err := os.MkdirAll(oldBin, 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(oldBin, "ipfs-v0.35.0"), []byte("old"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j := &Journal{From: "v0.35.0", To: "v0.36.0", InstallPath: installPath, Phase: PhaseStashed}
+	err = j.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Recover(context.Background(), j, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(installPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "old" {
+		t.Errorf("old binary not restored, got %q", data)
+	}
+	if checkNoJournal() != nil {
+		t.Error("expected journal to be removed")
+	}
+}
+
+func TestRollbackNoStash(t *testing.T) {
+	t.Setenv("IPFS_PATH", t.TempDir())
+
+	// there was no old binary to stash, and the new one was installed
+	installPath := filepath.Join(t.TempDir(), "ipfs")
+	err := os.WriteFile(installPath, []byte("new"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j := &Journal{From: "v0.35.0", To: "v0.36.0", InstallPath: installPath, Phase: PhaseInstalled, NoStash: true}
+	err = j.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Recover(context.Background(), j, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(installPath); !os.IsNotExist(err) {
+		t.Error("expected the new binary to be removed")
+	}
+	if checkNoJournal() != nil {
+		t.Error("expected journal to be removed")
+	}
+}
+
+func TestStashedFrom(t *testing.T) {
+	ipfsDir := t.TempDir()
+	oldBin := filepath.Join(ipfsDir, "old-bin")
+	err := os.MkdirAll(oldBin, 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j := &Journal{From: "v0.35.0", To: "v0.36.0", Phase: PhaseVerified, Started: time.Now().Add(-time.Minute)}
+	if p := stashedFrom(ipfsDir, j); p != "" {
+		t.Errorf("expected no stash yet, got %s", p)
+	}
+
+	err = os.WriteFile(filepath.Join(oldBin, "path-old"), []byte("/usr/local/bin/ipfs\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := stashedFrom(ipfsDir, j); p != "/usr/local/bin/ipfs" {
+		t.Errorf("expected the stashed path, got %q", p)
+	}
+
+	// left behind by an earlier install
+	j.Started = time.Now().Add(time.Minute)
+	if p := stashedFrom(ipfsDir, j); p != "" {
+		t.Errorf("expected an older stash to be ignored, got %s", p)
+	}
+}
+
+func TestSuspendKeepsBinary(t *testing.T) {
+	t.Setenv("IPFS_PATH", t.TempDir())
+	dir, err := os.MkdirTemp("", "ipfs-update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bin := filepath.Join(dir, "ipfs")
+	err = os.WriteFile(bin, []byte("new"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := NewInstall("v0.36.0", false, false, nil)
+	i.currentVers = "v0.35.0"
+	i.tmpBinPath = bin
+	i.journal(PhaseVerified)
+
+	i.Suspend()
+	if checkNoJournal() != nil {
+		t.Error("expected the journal to be removed")
+	}
+	if _, err := os.Stat(bin); err != nil {
+		t.Errorf("expected the binary to be kept: %s", err)
+	}
+
+	i.Discard()
+	if _, err := os.Stat(bin); !os.IsNotExist(err) {
+		t.Error("expected the binary to be removed")
+	}
+}
@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ipfs/ipfs-update/util"
+	"github.com/ipfs/kubo/repo/fsrepo/migrations"
+	"github.com/whyrusleeping/stump"
+)
+
+// lockFile is the name of the file in the ipfs directory locked while an
+// update modifies the installed binary, its stashes or the repo.
+const lockFile = "update.lock"
+
+// lockPollInterval is how often a held lock is retried while waiting.
+const lockPollInterval = 500 * time.Millisecond
+
+// lockPath returns the path of the update lock. If there is no ipfs
+// directory yet, a lock in the temporary directory is used instead.
+func lockPath() string {
+	ipfsDir, err := migrations.CheckIpfsDir("")
+	if err != nil {
+		return filepath.Join(os.TempDir(), "ipfs-update.lock")
+	}
+	return filepath.Join(ipfsDir, lockFile)
+}
+
+// AcquireLock takes the update lock, so that no two updates run at once. If
+// another update holds it, AcquireLock waits up to wait for it to be
+// released.
+func AcquireLock(ctx context.Context, wait time.Duration) (io.Closer, error) {
+	path := lockPath()
+	deadline := time.Now().Add(wait)
+	waiting := false
+	for {
+		l, err := util.TryLock(path)
+		if err == nil {
+			return l, nil
+		}
+		if !errors.Is(err, util.ErrLocked) {
+			return nil, fmt.Errorf("could not lock %s: %s", path, err)
+		}
+
+		if time.Now().After(deadline) {
+			return nil, lockedError(path)
+		}
+		if !waiting {
+			stump.Log("waiting for %s", lockedError(path))
+			waiting = true
+		}
+
+		select {
+		case <-time.After(lockPollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func lockedError(path string) error {
+	if pid := util.LockHolder(path); pid != 0 {
+		return fmt.Errorf("another update in progress (pid %d)", pid)
+	}
+	return errors.New("another update in progress")
+}
@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ipfs/kubo/repo/fsrepo/migrations"
+	"github.com/whyrusleeping/stump"
+)
+
+// Metrics is a snapshot of the update state of a node.
+type Metrics struct {
+	// Installed is the installed version, "none" if there is none.
+	Installed string
+	// Latest is the latest version permitted by the policy, empty if it
+	// could not be determined.
+	Latest string
+	// RepoVersion is the version of the repo, 0 if there is none.
+	RepoVersion int
+	// StashedCount and StashedBytes are the number and total size of the
+	// binaries stashed in the old-bin directory.
+	StashedCount int
+	StashedBytes int64
+	// State is the outcome of the last install.
+	State *State
+}
+
+// GatherMetrics collects the update state of the node.
+func GatherMetrics(ctx context.Context, fetcher migrations.Fetcher, policy *Policy) (*Metrics, error) {
+	m := new(Metrics)
+
+	var err error
+	m.Installed, err = CurrentIpfsVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	m.Latest, err = ResolveVersion(ctx, fetcher, "latest", policy)
+	if err != nil {
+		stump.Error("failed to query latest version: %s", err)
+		m.Latest = ""
+	}
+
+	m.RepoVersion, err = migrations.RepoVersion("")
+	if err != nil {
+		m.RepoVersion = 0
+	}
+
+	bins, err := StashedBinaries()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range bins {
+		m.StashedCount++
+		m.StashedBytes += b.Size
+	}
+
+	m.State, err = LoadState()
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Write writes the metrics in the prometheus text exposition format.
+func (m *Metrics) Write(w io.Writer) error {
+	var buf bytes.Buffer
+	gauge := func(name, help string, value interface{}, labels ...string) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		if len(labels) == 2 {
+			fmt.Fprintf(&buf, "%s{%s=%q} %v\n", name, labels[0], labels[1], value)
+		} else {
+			fmt.Fprintf(&buf, "%s %v\n", name, value)
+		}
+	}
+	boolValue := func(b bool) int {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	gauge("ipfs_update_installed_version_info", "Installed version of kubo.", 1, "version", m.Installed)
+
+	gauge("ipfs_update_latest_check_success", "Whether the latest version could be determined.", boolValue(m.Latest != ""))
+	if m.Latest != "" {
+		gauge("ipfs_update_latest_version_info", "Latest version of kubo permitted by the version policy.", 1, "version", m.Latest)
+		if m.Installed != "none" {
+			update, err := ClassifyUpdate(m.Installed, m.Latest)
+			if err == nil {
+				gauge("ipfs_update_update_available", "Kind of update available: 0 none, 1 patch, 2 minor, 3 major.", int(update))
+			}
+		}
+	}
+
+	gauge("ipfs_update_repo_version", "Version of the ipfs repo, 0 if there is none.", m.RepoVersion)
+	gauge("ipfs_update_stashed_binaries", "Number of binaries stashed in old-bin.", m.StashedCount)
+	gauge("ipfs_update_stashed_binaries_bytes", "Total size of the binaries stashed in old-bin.", m.StashedBytes)
+
+	if !m.State.LastInstall.IsZero() {
+		gauge("ipfs_update_last_install_timestamp_seconds", "When the last install finished.", m.State.LastInstall.Unix())
+		gauge("ipfs_update_last_install_success", "Whether the last install succeeded.", boolValue(m.State.LastSucceeded), "version", m.State.LastVersion)
+		gauge("ipfs_update_last_migration_duration_seconds", "How long the repo migrations of the last install took, 0 if it ran none.", m.State.LastMigration.Seconds())
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// WriteTextfile atomically replaces the file at path with the metrics, so
+// that the node exporter textfile collector never reads a partial file.
+func (m *Metrics) WriteTextfile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = m.Write(tmp)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmp.Name(), 0o644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
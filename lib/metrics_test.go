@@ -0,0 +1,65 @@
+package lib
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	m := &Metrics{
+		Installed:    "v0.35.0",
+		Latest:       "v0.36.0",
+		RepoVersion:  16,
+		StashedCount: 2,
+		StashedBytes: 1024,
+		State: &State{
+			LastInstall:   time.Unix(1700000000, 0),
+			LastVersion:   "v0.35.0",
+			LastSucceeded: true,
+			LastMigration: 1500 * time.Millisecond,
+		},
+	}
+
+	var buf bytes.Buffer
+	err := m.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		`ipfs_update_installed_version_info{version="v0.35.0"} 1`,
+		`ipfs_update_latest_check_success 1`,
+		`ipfs_update_latest_version_info{version="v0.36.0"} 1`,
+		`ipfs_update_update_available 2`,
+		`ipfs_update_repo_version 16`,
+		`ipfs_update_stashed_binaries 2`,
+		`ipfs_update_stashed_binaries_bytes 1024`,
+		`ipfs_update_last_install_timestamp_seconds 1700000000`,
+		`ipfs_update_last_install_success{version="v0.35.0"} 1`,
+		`ipfs_update_last_migration_duration_seconds 1.5`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestMetricsWriteNoInstall(t *testing.T) {
+	m := &Metrics{Installed: "none", State: new(State)}
+
+	var buf bytes.Buffer
+	err := m.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	if !strings.Contains(out, "ipfs_update_latest_check_success 0\n") {
+		t.Errorf("expected failed latest check in:\n%s", out)
+	}
+	if strings.Contains(out, "ipfs_update_last_install") {
+		t.Errorf("unexpected last install metrics in:\n%s", out)
+	}
+}
@@ -7,41 +7,62 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ipfs/kubo/repo/fsrepo/migrations"
 	"github.com/whyrusleeping/stump"
 )
 
-func checkMigration(ctx context.Context, fetcher migrations.Fetcher, binPath string) error {
+// checkMigration runs the repo migrations needed by the binary at binPath,
+// and returns how long they took. Once started, migrations run to completion
+// even if ctx is cancelled, as interrupting them could corrupt the repo.
+func checkMigration(ctx context.Context, fetcher migrations.Fetcher, binPath string) (time.Duration, error) {
 	stump.Log("checking if repo migration is needed...")
 
 	oldVer, err := migrations.RepoVersion("")
 	if os.IsNotExist(err) {
 		stump.VLog("  - no prexisting repo to migrate")
-		return nil
+		return 0, nil
 	}
 
 	stump.VLog("  - old repo version is %d", oldVer)
 
 	newVer, err := ipfsRepoVersion(ctx, binPath)
 	if err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
 		stump.Log("Failed to check new binary repo version.")
 		stump.VLog("Reason: ", err)
 		stump.Log("This is not an error.")
 		stump.Log("This just means that you may have to manually run the migration")
 		stump.Log("You will be prompted to do so upon starting the ipfs daemon if necessary")
-		return nil
+		return 0, nil
 	}
 
 	stump.VLog("  - repo version of new binary is %d", newVer)
 
 	if oldVer != newVer {
 		stump.Log("  check complete, migration required.")
-		return migrations.RunMigration(ctx, fetcher, newVer, "", true)
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		start := time.Now()
+		var source string
+		err = migrations.RunMigration(withSource(context.WithoutCancel(ctx), &source), fetcher, newVer, "", true)
+		d := time.Since(start)
+		RecordHistory(HistoryEntry{
+			Action:   "migrate",
+			From:     strconv.Itoa(oldVer),
+			To:       strconv.Itoa(newVer),
+			Source:   source,
+			Duration: d,
+		}, err)
+		return d, err
 	}
 
 	stump.VLog("  check complete, no migration required.")
-	return nil
+	return 0, nil
 }
 
 // ipfsRepoVersion returns the repo version required by the ipfs daemon
@@ -0,0 +1,180 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	api "github.com/ipfs/go-ipfs-api"
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/kubo/repo/fsrepo/migrations"
+	"github.com/whyrusleeping/stump"
+)
+
+// addLayouts are the options of 'ipfs add' tried to reproduce the CID an
+// archive was published with: the defaults of older releases, and CIDv1 with
+// raw leaves.
+var addLayouts = []map[string]string{
+	{},
+	{"cid-version": "1"},
+}
+
+// pinTimeout bounds pinning each archive, as pinning by dist path may make
+// the node fetch it from the network.
+const pinTimeout = 5 * time.Minute
+
+// Pinner pins the release archives fetched through it into the local ipfs
+// node, so that other nodes can fetch them from this one. Archives are kept
+// until the fetch or install they are part of succeeded, then pinned by
+// PinKept.
+type Pinner struct {
+	// DistPath is the ipfs path of the distribution site. Archives whose CID
+	// cannot be reproduced from the downloaded bytes are pinned by their path
+	// under it, and fetched again by the node.
+	DistPath string
+
+	mu   sync.Mutex
+	dir  string
+	kept []*Archive
+}
+
+// FetchBinary works like the function of the same name, and keeps the
+// verified archive once the binary was unpacked, to be pinned by PinKept.
+func (p *Pinner) FetchBinary(ctx context.Context, fetcher migrations.Fetcher, dist, ver, binName, out string) (string, error) {
+	out, _, _, err := fetchBinary(ctx, fetcher, dist, ver, binName, out, fetchOptions{keep: p.keep})
+	return out, err
+}
+
+// FetchBinaryFor works like the function of the same name, and keeps the
+// archive like FetchBinary.
+func (p *Pinner) FetchBinaryFor(ctx context.Context, fetcher migrations.Fetcher, dist, ver, binName, out string, plat Platform) (string, string, string, error) {
+	return fetchBinary(ctx, fetcher, dist, ver, binName, out, fetchOptions{platform: plat, keep: p.keep})
+}
+
+// keep moves arc out of the temporary directory of its fetch, to be pinned
+// later. Failing to keep it is logged, not returned.
+func (p *Pinner) keep(arc *Archive) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.dir == "" {
+		dir, err := os.MkdirTemp("", "ipfs-update-pin")
+		if err != nil {
+			stump.Error("could not keep %s to pin it: %s", path.Base(arc.DistPath), err)
+			return
+		}
+		p.dir = dir
+	}
+
+	kept := *arc
+	kept.Path = filepath.Join(p.dir, fmt.Sprintf("%d-%s", len(p.kept), filepath.Base(arc.Path)))
+	err := os.Rename(arc.Path, kept.Path)
+	if err != nil {
+		stump.Error("could not keep %s to pin it: %s", path.Base(arc.DistPath), err)
+		return
+	}
+	p.kept = append(p.kept, &kept)
+}
+
+// PinKept pins the archives kept since the last call, each within
+// pinTimeout, then removes them. Failing to pin is logged, not returned.
+func (p *Pinner) PinKept(ctx context.Context) {
+	p.mu.Lock()
+	kept := p.kept
+	p.mu.Unlock()
+
+	for _, arc := range kept {
+		pctx, cancel := context.WithTimeout(ctx, pinTimeout)
+		pinned, err := p.Pin(pctx, arc)
+		cancel()
+		if err != nil {
+			stump.Error("could not pin %s: %s", path.Base(arc.DistPath), err)
+			continue
+		}
+		stump.Log("pinned %s", pinned)
+	}
+	p.Discard()
+}
+
+// Discard removes the kept archives without pinning them, e.g. once the
+// install they were fetched for failed.
+func (p *Pinner) Discard() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.dir != "" {
+		os.RemoveAll(p.dir)
+	}
+	p.dir = ""
+	p.kept = nil
+}
+
+// Pin pins arc into the local ipfs node and returns the pinned path. If
+// adding the archive reproduces the CID published in dist.json, that CID is
+// pinned without fetching anything. Otherwise, the path of the archive on the
+// distribution site is pinned, which the node fetches from the network.
+func (p *Pinner) Pin(ctx context.Context, arc *Archive) (string, error) {
+	sh, _, err := ApiShell("")
+	if err != nil {
+		return "", fmt.Errorf("no local ipfs node: %s", err)
+	}
+
+	if arc.CID != "" {
+		// only hash the archive until a layout matches, so that the others
+		// leave no blocks behind
+		for _, opts := range addLayouts {
+			c, err := addFile(ctx, sh, arc.Path, opts, false)
+			if err != nil {
+				return "", fmt.Errorf("could not hash archive: %s", err)
+			}
+			if c != arc.CID {
+				stump.VLog("archive hashes to %s, but it was published as %s", c, arc.CID)
+				continue
+			}
+			_, err = addFile(ctx, sh, arc.Path, opts, true)
+			if err != nil {
+				return "", fmt.Errorf("could not add archive: %s", err)
+			}
+			return "/ipfs/" + c, nil
+		}
+	}
+
+	if p.DistPath == "" {
+		return "", fmt.Errorf("cannot reproduce the published CID of %s", arc.DistPath)
+	}
+	distPath := path.Join(p.DistPath, arc.DistPath)
+	stump.VLog("pinning %s, the node may fetch it from the network", distPath)
+	err = sh.Request("pin/add", distPath).Exec(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	return distPath, nil
+}
+
+// addFile adds the file at filePath to the node and pins it, and returns
+// its CID. If pin is not set, the file is only hashed, not added.
+func addFile(ctx context.Context, sh *api.Shell, filePath string, opts map[string]string, pin bool) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	dir := files.NewSliceDirectory([]files.DirEntry{files.FileEntry("", files.NewReaderFile(f))})
+	rb := sh.Request("add").Option("pin", pin).Option("only-hash", !pin)
+	for k, v := range opts {
+		rb.Option(k, v)
+	}
+
+	var out struct {
+		Hash string
+	}
+	err = rb.Body(files.NewMultiFileReader(dir, true)).Exec(ctx, &out)
+	if err != nil {
+		return "", err
+	}
+	return out.Hash, nil
+}
@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// pinNode fakes the add and pin commands of a local ipfs node. Files added
+// with CIDv1 get the CID published in dist.json, others a different one.
+type pinNode struct {
+	mu     sync.Mutex
+	hashed []string
+	added  []string
+	pinned []string
+}
+
+func (n *pinNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch r.URL.Path {
+	case "/api/v0/version":
+		json.NewEncoder(w).Encode(map[string]string{"Version": "0.36.0"})
+	case "/api/v0/add":
+		io.Copy(io.Discard, r.Body)
+		hash := "QmOther"
+		if r.URL.Query().Get("cid-version") == "1" {
+			hash = "bafyPublished"
+		}
+		switch {
+		case r.URL.Query().Get("only-hash") == "true":
+			n.hashed = append(n.hashed, hash)
+		case r.URL.Query().Get("pin") == "true":
+			n.added = append(n.added, hash)
+			n.pinned = append(n.pinned, hash)
+		default:
+			http.Error(w, "archives must be hashed or pinned", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"Hash": hash})
+	case "/api/v0/pin/add":
+		arg := r.URL.Query().Get("arg")
+		n.pinned = append(n.pinned, arg)
+		json.NewEncoder(w).Encode(map[string][]string{"Pins": {arg}})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func startPinNode(t *testing.T) *pinNode {
+	ipfsDir := t.TempDir()
+	t.Setenv("IPFS_PATH", ipfsDir)
+
+	node := &pinNode{}
+	srv := httptest.NewServer(node)
+	t.Cleanup(srv.Close)
+
+	err := os.WriteFile(filepath.Join(ipfsDir, "api"), []byte(srv.URL), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+func TestPinArchive(t *testing.T) {
+	arcPath := filepath.Join(t.TempDir(), "kubo.tar.gz")
+	err := os.WriteFile(arcPath, []byte("archive"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Pinner{DistPath: "/ipns/dist.example"}
+	distPath := "kubo/v0.36.0/kubo_v0.36.0_linux-amd64.tar.gz"
+
+	node := startPinNode(t)
+	pinned, err := p.Pin(context.Background(), &Archive{Path: arcPath, DistPath: distPath, CID: "bafyPublished"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pinned != "/ipfs/bafyPublished" {
+		t.Errorf("expected the published CID to be pinned, got %s", pinned)
+	}
+	if len(node.hashed) != 2 || len(node.added) != 1 || len(node.pinned) != 1 || node.pinned[0] != "bafyPublished" {
+		t.Errorf("unexpected hashes %v, adds %v and pins %v", node.hashed, node.added, node.pinned)
+	}
+
+	node = startPinNode(t)
+	pinned, err = p.Pin(context.Background(), &Archive{Path: arcPath, DistPath: distPath, CID: "bafyElsewhere"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pinned != "/ipns/dist.example/"+distPath {
+		t.Errorf("expected the dist path to be pinned, got %s", pinned)
+	}
+	if len(node.added) != 0 || len(node.pinned) != 1 || node.pinned[0] != pinned {
+		t.Errorf("expected no layout to be added, got adds %v and pins %v", node.added, node.pinned)
+	}
+
+	node = startPinNode(t)
+	_, err = p.Pin(context.Background(), &Archive{Path: arcPath, DistPath: distPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(node.hashed) != 0 || len(node.pinned) != 1 {
+		t.Errorf("expected only the dist path to be pinned without a CID, got hashes %v and pins %v", node.hashed, node.pinned)
+	}
+}
+
+func TestPinArchiveNoNode(t *testing.T) {
+	t.Setenv("IPFS_PATH", t.TempDir())
+	p := &Pinner{DistPath: "/ipns/dist.example"}
+	_, err := p.Pin(context.Background(), &Archive{Path: "kubo.tar.gz", DistPath: "kubo/v0.36.0/kubo.tar.gz"})
+	if err == nil {
+		t.Error("expected an error without a local node")
+	}
+}
+
+func TestPinnerFetchBinary(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("releases are zip archives on windows")
+	}
+	node := startPinNode(t)
+
+	fetcher := testRelease(t, "v0.36.0", []byte("ipfs"), "")
+	p := &Pinner{DistPath: "/ipns/dist.example"}
+	_, err := p.FetchBinary(context.Background(), fetcher, "kubo", "v0.36.0", "ipfs", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(node.pinned) != 0 {
+		t.Errorf("expected nothing to be pinned before PinKept, got %v", node.pinned)
+	}
+	kept := p.dir
+	p.PinKept(context.Background())
+	if _, err := os.Stat(kept); !os.IsNotExist(err) {
+		t.Error("kept archives were not removed")
+	}
+
+	arcName := fmt.Sprintf("kubo_v0.36.0_%s-%s.tar.gz", runtime.GOOS, runtime.GOARCH)
+	if len(node.pinned) != 1 || node.pinned[0] != "/ipns/dist.example/kubo/v0.36.0/"+arcName {
+		t.Errorf("unexpected pins %v", node.pinned)
+	}
+}
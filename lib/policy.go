@@ -0,0 +1,209 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/blang/semver/v4"
+	"github.com/ipfs/kubo/repo/fsrepo/migrations"
+)
+
+const (
+	// policyFile is the name of the policy file in the ipfs directory.
+	policyFile = "update-policy.json"
+	// systemPolicyPath is the system wide policy file, used when there is no
+	// policy file in the ipfs directory.
+	systemPolicyPath = "/etc/ipfs-update/policy.json"
+)
+
+// Policy restricts which versions of ipfs may be fetched and installed.
+type Policy struct {
+	// Allow is a semver range versions must satisfy, e.g. ">=0.30 <0.37".
+	Allow string `json:"allow,omitempty"`
+	// Deny lists versions that must never be installed.
+	Deny []string `json:"deny,omitempty"`
+	// AllowRC permits release candidates. Defaults to true.
+	AllowRC bool `json:"allow_rc"`
+	// AllowDowngrade permits installing a version older than the current
+	// one with --allow-downgrade. When false, downgrades are refused even
+	// with --allow-downgrade. Defaults to true.
+	AllowDowngrade bool `json:"allow_downgrade"`
+
+	// path the policy was loaded from, empty if there is none
+	path  string
+	allow semver.Range
+	deny  []semver.Version
+}
+
+// defaultPolicy returns the policy in effect when there is no policy file,
+// which permits everything.
+func defaultPolicy() *Policy {
+	return &Policy{AllowRC: true, AllowDowngrade: true}
+}
+
+// LoadPolicy reads the policy file at path. If path is empty, the policy file
+// in the ipfs directory is used, then the system wide one. If there is no
+// policy file, a policy permitting everything is returned.
+func LoadPolicy(path string) (*Policy, error) {
+	if path == "" {
+		path = findPolicy()
+		if path == "" {
+			return defaultPolicy(), nil
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read policy: %s", err)
+	}
+
+	p, err := parsePolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %s", path, err)
+	}
+	p.path = path
+
+	return p, nil
+}
+
+// findPolicy returns the path of the policy file in effect, or "" if there is
+// none.
+func findPolicy() string {
+	var candidates []string
+	if ipfsDir, err := migrations.IpfsDir(""); err == nil {
+		candidates = append(candidates, filepath.Join(ipfsDir, policyFile))
+	}
+	if runtime.GOOS != "windows" {
+		candidates = append(candidates, systemPolicyPath)
+	}
+
+	for _, c := range candidates {
+		if _, err := os.Stat(c); err == nil {
+			return c
+		}
+	}
+	return ""
+}
+
+func parsePolicy(data []byte) (*Policy, error) {
+	p := defaultPolicy()
+	err := json.Unmarshal(data, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Allow != "" {
+		p.allow, err = ParseRange(p.Allow)
+		if err != nil {
+			return nil, fmt.Errorf("bad allow range %q: %s", p.Allow, err)
+		}
+	}
+
+	for _, d := range p.Deny {
+		v, err := semver.ParseTolerant(d)
+		if err != nil {
+			return nil, fmt.Errorf("bad denied version %q: %s", d, err)
+		}
+		p.deny = append(p.deny, v)
+	}
+
+	return p, nil
+}
+
+// rangeOperators are the comparison operators of a range, longest first.
+var rangeOperators = []string{"<=", ">=", "!=", "<", ">", "=", "!"}
+
+// ParseRange parses a semver range such as ">=0.30 <0.37". Unlike
+// semver.ParseRange, versions may have a "v" prefix and omit the minor and
+// patch numbers.
+func ParseRange(s string) (semver.Range, error) {
+	fields := strings.Fields(s)
+	for i, f := range fields {
+		if f == "||" {
+			continue
+		}
+		op := ""
+		for _, o := range rangeOperators {
+			if strings.HasPrefix(f, o) {
+				op = o
+				break
+			}
+		}
+		vers := strings.TrimPrefix(f[len(op):], "v")
+		if vers == "" {
+			return nil, fmt.Errorf("missing version in %q", f)
+		}
+		// only pad the version core, not the prerelease or build metadata
+		core, suffix := vers, ""
+		if j := strings.IndexAny(vers, "-+"); j >= 0 {
+			core, suffix = vers[:j], vers[j:]
+		}
+		for strings.Count(core, ".") < 2 {
+			core += ".0"
+		}
+		fields[i] = op + core + suffix
+	}
+	return semver.ParseRange(strings.Join(fields, " "))
+}
+
+// Path returns the file the policy was loaded from, or "" if no policy file
+// is in effect.
+func (p *Policy) Path() string {
+	return p.path
+}
+
+// Check returns an error if the policy does not permit vers.
+func (p *Policy) Check(vers string) error {
+	v, err := semver.ParseTolerant(vers)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range p.deny {
+		if v.Equals(d) {
+			return fmt.Errorf("%s is denied by policy %s", vers, p.path)
+		}
+	}
+
+	if len(v.Pre) != 0 && !p.AllowRC {
+		return fmt.Errorf("release candidates are not allowed by policy %s", p.path)
+	}
+
+	if p.allow != nil {
+		// compare without prerelease, so that an RC of an allowed version
+		// is allowed as well
+		rel := v
+		rel.Pre = nil
+		if !p.allow(rel) {
+			return fmt.Errorf("%s is outside of %q allowed by policy %s", vers, p.Allow, p.path)
+		}
+	}
+
+	return nil
+}
+
+// CheckDowngrade returns an error if the policy does not permit replacing
+// version from with version to.
+func (p *Policy) CheckDowngrade(from, to string) error {
+	if p.AllowDowngrade {
+		return nil
+	}
+
+	vfrom, err := semver.ParseTolerant(from)
+	if err != nil {
+		return err
+	}
+	vto, err := semver.ParseTolerant(to)
+	if err != nil {
+		return err
+	}
+
+	if vto.LT(vfrom) {
+		return fmt.Errorf("downgrading from %s to %s is not allowed by policy %s", from, to, p.path)
+	}
+	return nil
+}
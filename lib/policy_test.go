@@ -0,0 +1,83 @@
+package lib
+
+import "testing"
+
+func TestParseRange(t *testing.T) {
+	r, err := ParseRange(">=0.30 <v0.37")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := defaultPolicy()
+	p.allow = r
+	for v, allowed := range map[string]bool{
+		"v0.29.0":     false,
+		"v0.30.0":     true,
+		"v0.36.1":     true,
+		"v0.37.0-rc1": false,
+		"v0.37.0":     false,
+	} {
+		if err := p.Check(v); (err == nil) != allowed {
+			t.Errorf("%s: expected allowed=%t, got error %v", v, allowed, err)
+		}
+	}
+
+	r, err = ParseRange(">=0.30.0-rc1 <0.31")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.allow = r
+	if err := p.Check("v0.30.0"); err != nil {
+		t.Errorf("expected a prerelease lower bound to allow its release: %s", err)
+	}
+
+	_, err = ParseRange(">=")
+	if err == nil {
+		t.Fatal("expected error for range without version")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	p, err := parsePolicy([]byte(`{
+		"allow": ">=0.30 <0.37",
+		"deny": ["v0.33.0"],
+		"allow_rc": false,
+		"allow_downgrade": false
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for v, allowed := range map[string]bool{
+		"v0.29.0":     false,
+		"v0.32.1":     true,
+		"v0.33.0":     false,
+		"v0.33.1":     true,
+		"v0.34.0-rc1": false,
+		"v0.36.0":     true,
+	} {
+		if err := p.Check(v); (err == nil) != allowed {
+			t.Errorf("%s: expected allowed=%t, got error %v", v, allowed, err)
+		}
+	}
+
+	if err := p.CheckDowngrade("v0.34.0", "v0.33.1"); err == nil {
+		t.Error("expected downgrade to be denied")
+	}
+	if err := p.CheckDowngrade("v0.33.1", "v0.34.0"); err != nil {
+		t.Errorf("expected upgrade to be allowed, got %s", err)
+	}
+
+	p, err = parsePolicy([]byte(`{"deny": ["v0.33.0"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.AllowRC || !p.AllowDowngrade {
+		t.Error("expected rc and downgrades to be allowed by default")
+	}
+
+	_, err = parsePolicy([]byte(`{"deny": ["latest"]}`))
+	if err == nil {
+		t.Fatal("expected error for invalid denied version")
+	}
+}
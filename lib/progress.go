@@ -0,0 +1,316 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/ipfs-update/util"
+	"github.com/mattn/go-isatty"
+	"github.com/whyrusleeping/stump"
+)
+
+// Transfer describes a download in progress.
+type Transfer struct {
+	// Name is the path of the file being downloaded.
+	Name string
+	// Source is the fetcher the file is downloaded from.
+	Source string
+	// Size is the size of the file, or -1 if it is not known.
+	Size    int64
+	Done    int64
+	Started time.Time
+}
+
+// Rate returns the average download rate so far, in bytes per second.
+func (t *Transfer) Rate() float64 {
+	d := time.Since(t.Started).Seconds()
+	if d <= 0 {
+		return 0
+	}
+	return float64(t.Done) / d
+}
+
+// Progress receives updates on downloads. Implementations must be safe for
+// concurrent use.
+type Progress interface {
+	// Update is called whenever more of t has been downloaded.
+	Update(t *Transfer)
+	// Finish is called once t has completed, or failed with err.
+	Finish(t *Transfer, err error)
+}
+
+// NewProgress returns a Progress writing to w in the given mode: "bar" draws a
+// progress bar, "lines" logs progress periodically, "json" writes one JSON
+// event per line and "none" reports nothing. "auto" draws a bar if w is a
+// terminal and logs lines otherwise.
+func NewProgress(mode string, w *os.File) (Progress, error) {
+	switch mode {
+	case "", "auto":
+		if isatty.IsTerminal(w.Fd()) || isatty.IsCygwinTerminal(w.Fd()) {
+			return &barProgress{w: w}, nil
+		}
+		return &lineProgress{w: w}, nil
+	case "bar":
+		return &barProgress{w: w}, nil
+	case "lines":
+		return &lineProgress{w: w}, nil
+	case "json":
+		return &jsonProgress{enc: json.NewEncoder(w)}, nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown progress mode %q", mode)
+	}
+}
+
+const (
+	barInterval  = 200 * time.Millisecond
+	lineInterval = 10 * time.Second
+	jsonInterval = time.Second
+	barWidth     = 30
+)
+
+// throttle tracks when each transfer was last reported.
+type throttle struct {
+	mu   sync.Mutex
+	last map[*Transfer]time.Time
+}
+
+// due reports whether t should be reported again after interval, and if so
+// records that it is.
+func (th *throttle) due(t *Transfer, interval time.Duration) bool {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	if th.last == nil {
+		th.last = make(map[*Transfer]time.Time)
+	}
+	last, ok := th.last[t]
+	if !ok {
+		// do not report downloads that complete right away
+		th.last[t] = t.Started
+		last = t.Started
+	}
+	if time.Since(last) < interval {
+		return false
+	}
+	th.last[t] = time.Now()
+	return true
+}
+
+func (th *throttle) forget(t *Transfer) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	delete(th.last, t)
+}
+
+type barProgress struct {
+	throttle
+	// mu serializes the writes of concurrent transfers
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (p *barProgress) Update(t *Transfer) {
+	if p.due(t, barInterval) {
+		p.write("\r%s", progressBar(t))
+	}
+}
+
+func (p *barProgress) Finish(t *Transfer, err error) {
+	p.forget(t)
+	if err != nil || time.Since(t.Started) >= barInterval {
+		p.write("\r%s\n", progressBar(t))
+	}
+}
+
+func (p *barProgress) write(format string, bar string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(p.w, format, bar)
+}
+
+func progressBar(t *Transfer) string {
+	var bar string
+	if t.Size > 0 {
+		frac := float64(t.Done) / float64(t.Size)
+		if frac > 1 {
+			frac = 1
+		}
+		n := int(frac * barWidth)
+		bar = fmt.Sprintf("[%s%s] %3.0f%% ", strings.Repeat("=", n), strings.Repeat(" ", barWidth-n), frac*100)
+	}
+	return fmt.Sprintf("%s %s%s  %s/s  from %s  ", path.Base(t.Name), bar, progressBytes(t), util.HumanBytes(int64(t.Rate())), t.Source)
+}
+
+func progressBytes(t *Transfer) string {
+	if t.Size < 0 {
+		return util.HumanBytes(t.Done)
+	}
+	return util.HumanBytes(t.Done) + " / " + util.HumanBytes(t.Size)
+}
+
+type lineProgress struct {
+	throttle
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (p *lineProgress) Update(t *Transfer) {
+	if p.due(t, lineInterval) {
+		p.printf("downloading %s from %s: %s, %s/s", path.Base(t.Name), t.Source, progressBytes(t), util.HumanBytes(int64(t.Rate())))
+	}
+}
+
+func (p *lineProgress) Finish(t *Transfer, err error) {
+	p.forget(t)
+	if !stump.Verbose {
+		return
+	}
+	if err != nil {
+		p.printf("download of %s from %s failed after %s: %s", path.Base(t.Name), t.Source, util.HumanBytes(t.Done), err)
+		return
+	}
+	p.printf("downloaded %s from %s: %s in %s", path.Base(t.Name), t.Source, util.HumanBytes(t.Done), time.Since(t.Started).Round(time.Millisecond))
+}
+
+func (p *lineProgress) printf(format string, args ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(p.w, format+"\n", args...)
+}
+
+// progressEvent is written by jsonProgress.
+type progressEvent struct {
+	Event  string  `json:"event"`
+	Name   string  `json:"name"`
+	Source string  `json:"source"`
+	Bytes  int64   `json:"bytes"`
+	Total  int64   `json:"total,omitempty"`
+	Rate   float64 `json:"rate"`
+	Error  string  `json:"error,omitempty"`
+}
+
+type jsonProgress struct {
+	throttle
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (p *jsonProgress) write(event string, t *Transfer, err error) {
+	ev := progressEvent{
+		Event:  event,
+		Name:   t.Name,
+		Source: t.Source,
+		Bytes:  t.Done,
+		Rate:   t.Rate(),
+	}
+	if t.Size >= 0 {
+		ev.Total = t.Size
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.enc.Encode(ev)
+}
+
+func (p *jsonProgress) Update(t *Transfer) {
+	if p.due(t, jsonInterval) {
+		p.write("progress", t, nil)
+	}
+}
+
+func (p *jsonProgress) Finish(t *Transfer, err error) {
+	p.forget(t)
+	if err != nil {
+		p.write("error", t, err)
+		return
+	}
+	p.write("done", t, nil)
+}
+
+// Transfers configures progress reporting and rate limiting of downloads.
+type Transfers struct {
+	// Progress receives updates on downloads, if not nil.
+	Progress Progress
+	// Limiter limits the download rate, if not nil. Fetchers sharing a
+	// limiter are limited to their combined rate.
+	Limiter *util.RateLimiter
+}
+
+// track wraps rc, a download of name from source with the given size (-1 if
+// unknown), to report its progress and limit its rate.
+func (ts Transfers) track(ctx context.Context, rc io.ReadCloser, name, source string, size int64) io.ReadCloser {
+	r := io.Reader(rc)
+	if ts.Limiter != nil {
+		r = ts.Limiter.LimitReader(ctx, r)
+	}
+	if ts.Progress == nil {
+		return readCloser{Reader: r, Closer: rc}
+	}
+
+	return &progressReader{
+		r: r,
+		c: rc,
+		p: ts.Progress,
+		t: &Transfer{
+			Name:    name,
+			Source:  source,
+			Size:    size,
+			Started: time.Now(),
+		},
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+var errDownloadAborted = errors.New("download aborted")
+
+// progressReader reports the progress of a download until it completes,
+// fails or is closed.
+type progressReader struct {
+	r        io.Reader
+	c        io.Closer
+	t        *Transfer
+	p        Progress
+	finished bool
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.t.Done += int64(n)
+		r.p.Update(r.t)
+	}
+	if err == io.EOF {
+		r.finish(nil)
+	} else if err != nil {
+		r.finish(err)
+	}
+	return n, err
+}
+
+func (r *progressReader) finish(err error) {
+	if !r.finished {
+		r.finished = true
+		r.p.Finish(r.t, err)
+	}
+}
+
+func (r *progressReader) Close() error {
+	r.finish(errDownloadAborted)
+	return r.c.Close()
+}
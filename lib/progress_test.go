@@ -0,0 +1,120 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordProgress struct {
+	mu       sync.Mutex
+	updates  int
+	finished *Transfer
+	err      error
+}
+
+func (p *recordProgress) Update(t *Transfer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.updates++
+}
+
+func (p *recordProgress) Finish(t *Transfer, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.finished = t
+	p.err = err
+}
+
+func TestTransfersTrack(t *testing.T) {
+	p := new(recordProgress)
+	ts := Transfers{Progress: p}
+	data := bytes.Repeat([]byte("x"), 100000)
+
+	rc := ts.track(context.Background(), io.NopCloser(bytes.NewReader(data)), "kubo/v0.1.0/kubo.tar.gz", "test", int64(len(data)))
+	out, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatal("data was not read correctly")
+	}
+	if p.updates == 0 {
+		t.Error("expected progress updates")
+	}
+	if p.finished == nil || p.finished.Done != int64(len(data)) || p.err != nil {
+		t.Errorf("unexpected finish: %+v, %v", p.finished, p.err)
+	}
+}
+
+type failReader struct{}
+
+func (failReader) Read([]byte) (int, error) { return 0, errors.New("boom") }
+
+func TestTransfersTrackError(t *testing.T) {
+	p := new(recordProgress)
+	ts := Transfers{Progress: p}
+
+	rc := ts.track(context.Background(), io.NopCloser(failReader{}), "versions", "test", -1)
+	_, err := io.ReadAll(rc)
+	rc.Close()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if p.err == nil {
+		t.Error("expected the error to be reported")
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	tr := &Transfer{
+		Name:    "kubo/v0.15.0/kubo_v0.15.0_linux-amd64.tar.gz",
+		Source:  "https://ipfs.io",
+		Size:    4 << 20,
+		Done:    1 << 20,
+		Started: time.Now().Add(-time.Second),
+	}
+	bar := progressBar(tr)
+	for _, s := range []string{"kubo_v0.15.0_linux-amd64.tar.gz", " 25%", "1.0 MiB / 4.0 MiB", "from https://ipfs.io"} {
+		if !strings.Contains(bar, s) {
+			t.Errorf("expected %q in %q", s, bar)
+		}
+	}
+
+	tr.Size = -1
+	if bar := progressBar(tr); strings.Contains(bar, "%") {
+		t.Errorf("unexpected percentage for unknown size: %q", bar)
+	}
+}
+
+func TestNewProgress(t *testing.T) {
+	if _, err := NewProgress("sparkles", nil); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+	p, err := NewProgress("none", nil)
+	if err != nil || p != nil {
+		t.Errorf("expected no progress, got %v, %v", p, err)
+	}
+}
+
+func TestLineProgress(t *testing.T) {
+	var buf bytes.Buffer
+	p := &lineProgress{w: &buf}
+	tr := &Transfer{
+		Name:    "kubo/v0.15.0/kubo_v0.15.0_linux-amd64.tar.gz",
+		Source:  "https://ipfs.io",
+		Size:    4 << 20,
+		Done:    1 << 20,
+		Started: time.Now().Add(-lineInterval),
+	}
+	p.Update(tr)
+	if !strings.Contains(buf.String(), "downloading kubo_v0.15.0_linux-amd64.tar.gz from https://ipfs.io") {
+		t.Errorf("expected a progress line on the given writer, got %q", buf.String())
+	}
+}
@@ -0,0 +1,168 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ipfs/kubo/repo/fsrepo/migrations"
+	"github.com/whyrusleeping/stump"
+)
+
+// RaceFetcher fetches each file from several of its fetchers at once, and
+// takes the first complete response, cancelling the others. This avoids
+// waiting for a slow source, such as a local node that does not have the
+// release cached, to time out before trying the next one.
+//
+// DownloadFile only races downloads that are verified against a digest, and
+// tries the fetchers in turn otherwise.
+type RaceFetcher struct {
+	fetchers []migrations.Fetcher
+	n        int
+}
+
+// NewRaceFetcher creates a RaceFetcher racing the first n of fetchers. If all
+// of them fail, the remaining fetchers are tried in turn.
+func NewRaceFetcher(n int, fetchers ...migrations.Fetcher) *RaceFetcher {
+	if n < 1 {
+		n = 1
+	}
+	if n > len(fetchers) {
+		n = len(fetchers)
+	}
+	f := &RaceFetcher{
+		fetchers: make([]migrations.Fetcher, len(fetchers)),
+		n:        n,
+	}
+	copy(f.fetchers, fetchers)
+	return f
+}
+
+type raceResult struct {
+	i    int
+	data []byte
+	sum  string
+	src  string
+	err  error
+}
+
+// race runs fetch with each of the racing fetchers, and returns the first
+// successful result. The others are cancelled, and have returned by the time
+// race does. Each racer records its source apart, so that only the winner is
+// attributed the fetch.
+func (f *RaceFetcher) race(ctx context.Context, fetch func(ctx context.Context, i int) raceResult) (raceResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan raceResult, f.n)
+	for i := 0; i < f.n; i++ {
+		go func(i int) {
+			var src string
+			r := fetch(withSource(ctx, &src), i)
+			r.src = src
+			results <- r
+		}(i)
+	}
+
+	var errs []string
+	for n := 1; n <= f.n; n++ {
+		r := <-results
+		if r.err == nil {
+			cancel()
+			for ; n < f.n; n++ {
+				<-results
+			}
+			return r, nil
+		}
+		if ctx.Err() == nil {
+			errs = append(errs, r.err.Error())
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return raceResult{}, err
+	}
+	return raceResult{}, errors.New(strings.Join(errs, "; "))
+}
+
+// Fetch fetches the file at filePath from the racing fetchers at once, then
+// from the remaining ones in turn.
+func (f *RaceFetcher) Fetch(ctx context.Context, filePath string) ([]byte, error) {
+	r, err := f.race(ctx, func(ctx context.Context, i int) raceResult {
+		data, err := f.fetchers[i].Fetch(ctx, filePath)
+		return raceResult{i: i, data: data, err: err}
+	})
+	if err == nil {
+		recordSource(ctx, r.src)
+		return r.data, nil
+	}
+	if ctx.Err() != nil {
+		return nil, err
+	}
+	stump.Log("error fetching %s: %s", filePath, err)
+
+	for _, fetcher := range f.fetchers[f.n:] {
+		data, ferr := fetcher.Fetch(ctx, filePath)
+		if ferr == nil {
+			return data, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		stump.Log("error fetching %s: %s", filePath, ferr)
+		err = ferr
+	}
+	return nil, err
+}
+
+// download races the download of filePath, each racing fetcher writing to a
+// partial download of its own next to part. It returns the digest and the
+// path of the winning download, the first one to complete and match digest.
+func (f *RaceFetcher) download(ctx context.Context, filePath, part, digest string) (string, string, error) {
+	racePart := func(i int) string {
+		return fmt.Sprintf("%s.%d.part", strings.TrimSuffix(part, ".part"), i)
+	}
+
+	r, err := f.race(ctx, func(ctx context.Context, i int) raceResult {
+		sum, err := downloadAttempts(ctx, fetchAttempts(f.fetchers[i]), filePath, racePart(i), digest)
+		return raceResult{i: i, sum: sum, err: err}
+	})
+	if err == nil {
+		recordSource(ctx, r.src)
+		// the losing downloads are of no further use
+		for i := 0; i < f.n; i++ {
+			if i != r.i {
+				os.Remove(racePart(i))
+			}
+		}
+		return r.sum, racePart(r.i), nil
+	}
+	if ctx.Err() != nil {
+		return "", "", ctx.Err()
+	}
+	stump.Log("error fetching %s: %s", filePath, err)
+
+	var attempts []migrations.Fetcher
+	for _, fetcher := range f.fetchers[f.n:] {
+		attempts = append(attempts, fetchAttempts(fetcher)...)
+	}
+	if len(attempts) == 0 {
+		return "", "", err
+	}
+	sum, err := downloadAttempts(ctx, attempts, filePath, part, digest)
+	return sum, part, err
+}
+
+func (f *RaceFetcher) Close() error {
+	var errs []string
+	for _, fetcher := range f.fetchers {
+		if err := fetcher.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
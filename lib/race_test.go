@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// slowFetcher blocks until its context is cancelled.
+type slowFetcher struct {
+	cancelled chan struct{}
+}
+
+func (f *slowFetcher) Fetch(ctx context.Context, filePath string) ([]byte, error) {
+	<-ctx.Done()
+	close(f.cancelled)
+	return nil, ctx.Err()
+}
+
+func (f *slowFetcher) Close() error { return nil }
+
+func TestRaceFetcher(t *testing.T) {
+	slow := &slowFetcher{cancelled: make(chan struct{})}
+	fetcher := NewRaceFetcher(2, slow, memFetcher{"kubo/versions": []byte("v0.36.0\n")})
+
+	data, err := fetcher.Fetch(context.Background(), "kubo/versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "v0.36.0\n" {
+		t.Errorf("unexpected data %q", data)
+	}
+
+	select {
+	case <-slow.cancelled:
+	case <-time.After(5 * time.Second):
+		t.Error("slow fetcher was not cancelled")
+	}
+}
+
+func TestRaceFetcherFallback(t *testing.T) {
+	fetcher := NewRaceFetcher(2, memFetcher{}, memFetcher{}, memFetcher{"kubo/versions": []byte("v0.36.0\n")})
+
+	data, err := fetcher.Fetch(context.Background(), "kubo/versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "v0.36.0\n" {
+		t.Errorf("unexpected data %q", data)
+	}
+
+	_, err = NewRaceFetcher(2, memFetcher{}, memFetcher{}).Fetch(context.Background(), "kubo/versions")
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestRaceDownloadVerified(t *testing.T) {
+	t.Setenv("IPFS_PATH", t.TempDir())
+	data := bytes.Repeat([]byte("kubo"), 10000)
+	sum := sha512.Sum512(data)
+
+	// the first source serves a corrupt archive, so the second must win
+	fetcher := NewRaceFetcher(3,
+		TrackSource("corrupt", memFetcher{"kubo.tar.gz": []byte("corrupt")}),
+		TrackSource("good", memFetcher{"kubo.tar.gz": data}),
+		&slowFetcher{cancelled: make(chan struct{})})
+
+	dest := filepath.Join(t.TempDir(), "kubo.tar.gz")
+	var src string
+	_, err := DownloadFile(withSource(context.Background(), &src), fetcher, "kubo.tar.gz", dest, hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Error("the corrupt download won")
+	}
+	if src != "good" {
+		t.Errorf("expected the winner to be recorded as the source, got %q", src)
+	}
+
+	part := partialFile(t, fetcher, "kubo.tar.gz")
+	matches, err := filepath.Glob(filepath.Join(filepath.Dir(part), "*.part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("partial downloads left behind: %s", matches)
+	}
+}
+
+func TestRaceDownloadUnverified(t *testing.T) {
+	t.Setenv("IPFS_PATH", t.TempDir())
+	data := bytes.Repeat([]byte("kubo"), 10000)
+
+	// without a digest, the fetchers are tried in turn instead of raced
+	fetcher := NewRaceFetcher(2,
+		TrackSource("first", memFetcher{"kubo.tar.gz": data}),
+		TrackSource("second", memFetcher{"kubo.tar.gz": []byte("other")}))
+
+	dest := filepath.Join(t.TempDir(), "kubo.tar.gz")
+	var src string
+	_, err := DownloadFile(withSource(context.Background(), &src), fetcher, "kubo.tar.gz", dest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) || src != "first" {
+		t.Errorf("expected the download of the first fetcher, got %d bytes from %q", len(out), src)
+	}
+}
+
+func TestRaceDownloadCancelled(t *testing.T) {
+	t.Setenv("IPFS_PATH", t.TempDir())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	fetcher := NewRaceFetcher(2, &slowFetcher{cancelled: make(chan struct{})}, memFetcher{})
+	_, err := DownloadFile(ctx, fetcher, "kubo.tar.gz", filepath.Join(t.TempDir(), "out"), "")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %s, got %v", context.Canceled, err)
+	}
+}
@@ -0,0 +1,252 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/kubo/repo/fsrepo/migrations"
+)
+
+// ReleaseLock pins a release of kubo, and the repo migrations it needs, to
+// the exact archives to install, so that installs are reproducible.
+type ReleaseLock struct {
+	// DistRoot is the immutable /ipfs path of the snapshot of the
+	// distribution site the archives are fetched from.
+	DistRoot string `json:"dist_root"`
+	Version  string `json:"version"`
+	// Archives are the archives of the release, by "GOOS-GOARCH" platform.
+	Archives map[string]LockedArchive `json:"archives"`
+	// Migrations are the repo migrations needed to install the release.
+	Migrations []LockedMigration `json:"migrations,omitempty"`
+}
+
+// LockedArchive is an archive of a ReleaseLock.
+type LockedArchive struct {
+	// Path is the path of the archive on the distribution site.
+	Path   string `json:"path"`
+	CID    string `json:"cid,omitempty"`
+	SHA512 string `json:"sha512"`
+}
+
+// LockedMigration is a repo migration of a ReleaseLock.
+type LockedMigration struct {
+	Name     string                   `json:"name"`
+	Version  string                   `json:"version"`
+	Archives map[string]LockedArchive `json:"archives"`
+}
+
+// ArchivePath returns the path on the distribution site of the archive of
+// version ver of dist for goos and goarch.
+func ArchivePath(dist, ver, goos, goarch string) string {
+	name := path.Base(dist)
+	return fmt.Sprintf("%s/%s/%s_%s_%s-%s.%s", dist, ver, name, ver, goos, goarch, archiveType(goos))
+}
+
+// archiveType returns the type of the release archives for goos.
+func archiveType(goos string) string {
+	if goos == "windows" {
+		return "zip"
+	}
+	return "tar.gz"
+}
+
+// CreateReleaseLock locks version vers of kubo as published under distRoot,
+// which fetcher must fetch from, along with the migrations needed to install
+// it over a repo of version fromRepo. No migrations are locked if fromRepo is
+// 0.
+func CreateReleaseLock(ctx context.Context, fetcher migrations.Fetcher, distRoot, vers string, fromRepo int) (*ReleaseLock, error) {
+	if !strings.HasPrefix(distRoot, "/ipfs/") {
+		return nil, fmt.Errorf("dist root %s is not an immutable /ipfs path", distRoot)
+	}
+
+	l := &ReleaseLock{DistRoot: distRoot, Version: vers}
+	var err error
+	l.Archives, err = lockArchives(ctx, fetcher, "kubo", vers)
+	if err != nil {
+		return nil, err
+	}
+
+	if fromRepo == 0 {
+		return l, nil
+	}
+	toRepo, ok := RequiredRepoVersion(vers)
+	if !ok {
+		return nil, fmt.Errorf("repo version of %s is not known, cannot lock its migrations", vers)
+	}
+	for _, name := range migrationNames(fromRepo, toRepo) {
+		ver, err := migrations.LatestDistVersion(ctx, fetcher, name, false)
+		if err != nil {
+			return nil, fmt.Errorf("could not get latest version of migration %s: %s", name, err)
+		}
+		archives, err := lockArchives(ctx, fetcher, name, ver)
+		if err != nil {
+			return nil, err
+		}
+		l.Migrations = append(l.Migrations, LockedMigration{
+			Name:     name,
+			Version:  ver,
+			Archives: archives,
+		})
+	}
+	return l, nil
+}
+
+// migrationNames returns the migrations run to migrate a repo from version
+// from to version to, in either direction.
+func migrationNames(from, to int) []string {
+	var names []string
+	for cur := from; cur < to; cur++ {
+		names = append(names, fmt.Sprintf("fs-repo-%d-to-%d", cur, cur+1))
+	}
+	for cur := from; cur > to; cur-- {
+		names = append(names, fmt.Sprintf("fs-repo-%d-to-%d", cur-1, cur))
+	}
+	return names
+}
+
+// lockArchives returns the archives of version ver of dist listed with a
+// digest in its dist.json.
+func lockArchives(ctx context.Context, fetcher migrations.Fetcher, dist, ver string) (map[string]LockedArchive, error) {
+	info, err := FetchDistInfo(ctx, fetcher, dist, ver)
+	if err != nil {
+		return nil, fmt.Errorf("could not get dist.json of %s %s: %s", dist, ver, err)
+	}
+
+	archives := make(map[string]LockedArchive)
+	for goos, p := range info.Platforms {
+		for goarch, art := range p.Archs {
+			if art.SHA512 == "" {
+				continue
+			}
+			archives[goos+"-"+goarch] = LockedArchive{
+				Path:   ArchivePath(dist, ver, goos, goarch),
+				CID:    art.CID,
+				SHA512: art.SHA512,
+			}
+		}
+	}
+	if len(archives) == 0 {
+		return nil, fmt.Errorf("dist.json of %s %s has no archive digests", dist, ver)
+	}
+	return archives, nil
+}
+
+// ReadReleaseLock reads the ReleaseLock at path.
+func ReadReleaseLock(path string) (*ReleaseLock, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	l := new(ReleaseLock)
+	err = json.Unmarshal(data, l)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lock file %s: %s", path, err)
+	}
+	if !strings.HasPrefix(l.DistRoot, "/ipfs/") || l.Version == "" || len(l.Archives) == 0 {
+		return nil, fmt.Errorf("invalid lock file %s: missing dist root, version or archives", path)
+	}
+	return l, nil
+}
+
+// Write writes l to path.
+func (l *ReleaseLock) Write(path string) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// Archive returns the locked archive of the release for goos and goarch.
+func (l *ReleaseLock) Archive(goos, goarch string) (LockedArchive, error) {
+	a, ok := l.Archives[goos+"-"+goarch]
+	if !ok || a.SHA512 == "" {
+		return LockedArchive{}, fmt.Errorf("lock file has no archive of %s for %s-%s", l.Version, goos, goarch)
+	}
+	return a, nil
+}
+
+// Platforms returns the platforms the release is locked for, sorted.
+func (l *ReleaseLock) Platforms() []string {
+	platforms := make([]string, 0, len(l.Archives))
+	for p := range l.Archives {
+		platforms = append(platforms, p)
+	}
+	sort.Strings(platforms)
+	return platforms
+}
+
+// CheckMigrations checks that l locks the migrations, for goos and goarch,
+// needed to install its release over a repo of version repo, so that a lock
+// missing some fails before anything is downloaded or installed. Nothing is
+// checked if the repo version of the release is not known.
+func (l *ReleaseLock) CheckMigrations(repo int, goos, goarch string) error {
+	toRepo, ok := RequiredRepoVersion(l.Version)
+	if !ok {
+		return nil
+	}
+
+	locked := make(map[string]LockedMigration)
+	for _, m := range l.Migrations {
+		locked[m.Name] = m
+	}
+	for _, name := range migrationNames(repo, toRepo) {
+		m, ok := locked[name]
+		if !ok {
+			return fmt.Errorf("lock file has no migration %s for the repo of version %d, lock it again with --from-repo %d", name, repo, repo)
+		}
+		if a, ok := m.Archives[goos+"-"+goarch]; !ok || a.SHA512 == "" {
+			return fmt.Errorf("lock file has no archive of migration %s for %s-%s", name, goos, goarch)
+		}
+	}
+	return nil
+}
+
+// Fetcher returns a fetcher fetching with f, which fails to fetch any archive
+// that is not locked by l or does not match its locked digest. Other files,
+// such as version lists, are fetched as they are.
+func (l *ReleaseLock) Fetcher(f migrations.Fetcher) migrations.Fetcher {
+	digests := make(map[string]string)
+	for _, a := range l.Archives {
+		digests[a.Path] = a.SHA512
+	}
+	for _, m := range l.Migrations {
+		for _, a := range m.Archives {
+			digests[a.Path] = a.SHA512
+		}
+	}
+	return &lockedFetcher{Fetcher: f, digests: digests}
+}
+
+type lockedFetcher struct {
+	migrations.Fetcher
+	digests map[string]string
+}
+
+func (f *lockedFetcher) Fetch(ctx context.Context, filePath string) ([]byte, error) {
+	if !strings.HasSuffix(filePath, ".tar.gz") && !strings.HasSuffix(filePath, ".zip") {
+		return f.Fetcher.Fetch(ctx, filePath)
+	}
+
+	digest, ok := f.digests[filePath]
+	if !ok {
+		return nil, fmt.Errorf("%s is not in the lock file", filePath)
+	}
+	data, err := f.Fetcher.Fetch(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha512.Sum512(data)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), digest) {
+		return nil, fmt.Errorf("digest mismatch: %s does not match the sha512 %s of the lock file", filePath, digest)
+	}
+	return data, nil
+}
@@ -0,0 +1,161 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func sha512Hex(data []byte) string {
+	sum := sha512.Sum512(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// lockRelease adds to f the dist.json of vers of dist, listing archives for
+// linux-amd64 and windows-arm64, and one without a digest for windows-386.
+func lockRelease(t *testing.T, f memFetcher, dist, vers string) {
+	info := DistInfo{
+		Version: vers,
+		Platforms: map[string]DistPlatform{
+			"linux":   {Archs: map[string]DistArtifact{"amd64": {CID: "bafyLinux", SHA512: "aa"}}},
+			"windows": {Archs: map[string]DistArtifact{"arm64": {SHA512: "bb"}, "386": {}}},
+		},
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f[dist+"/"+vers+"/dist.json"] = data
+}
+
+func TestCreateReleaseLock(t *testing.T) {
+	f := memFetcher{"fs-repo-16-to-17/versions": []byte("v1.0.0\nv1.0.1\n")}
+	lockRelease(t, f, "kubo", "v0.37.0")
+	lockRelease(t, f, "fs-repo-16-to-17", "v1.0.1")
+
+	_, err := CreateReleaseLock(context.Background(), f, "/ipns/dist.ipfs.tech", "v0.37.0", 16)
+	if err == nil {
+		t.Error("expected an error for a mutable dist root")
+	}
+
+	lock, err := CreateReleaseLock(context.Background(), f, "/ipfs/QmRoot", "v0.37.0", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lock.Archives) != 2 {
+		t.Errorf("expected the two archives with digests, got %v", lock.Archives)
+	}
+	a, err := lock.Archive("windows", "arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Path != "kubo/v0.37.0/kubo_v0.37.0_windows-arm64.zip" || a.SHA512 != "bb" {
+		t.Errorf("unexpected archive %+v", a)
+	}
+	if _, err := lock.Archive("windows", "386"); err == nil {
+		t.Error("expected no archive without a digest")
+	}
+	if len(lock.Migrations) != 1 || lock.Migrations[0].Name != "fs-repo-16-to-17" || lock.Migrations[0].Version != "v1.0.1" {
+		t.Errorf("unexpected migrations %+v", lock.Migrations)
+	}
+
+	path := filepath.Join(t.TempDir(), "ipfs-update.lock")
+	err = lock.Write(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadReleaseLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.DistRoot != "/ipfs/QmRoot" || read.Migrations[0].Archives["linux-amd64"].CID != "bafyLinux" {
+		t.Errorf("lock file did not round trip: %+v", read)
+	}
+}
+
+func TestMigrationNames(t *testing.T) {
+	up := migrationNames(14, 16)
+	if len(up) != 2 || up[0] != "fs-repo-14-to-15" || up[1] != "fs-repo-15-to-16" {
+		t.Errorf("unexpected migrations %v", up)
+	}
+	down := migrationNames(16, 15)
+	if len(down) != 1 || down[0] != "fs-repo-15-to-16" {
+		t.Errorf("unexpected revert migrations %v", down)
+	}
+}
+
+func TestLockedFetcher(t *testing.T) {
+	arc := []byte("migration archive")
+	path := "fs-repo-16-to-17/v1.0.1/fs-repo-16-to-17_v1.0.1_linux-amd64.tar.gz"
+	lock := &ReleaseLock{
+		Migrations: []LockedMigration{{
+			Name:    "fs-repo-16-to-17",
+			Version: "v1.0.1",
+			Archives: map[string]LockedArchive{
+				"linux-amd64": {Path: path, SHA512: sha512Hex(arc)},
+			},
+		}},
+	}
+	inner := memFetcher{
+		"fs-repo-16-to-17/versions": []byte("v1.0.1\n"),
+		path:                        arc,
+		"fs-repo-16-to-17/v1.0.1/fs-repo-16-to-17_v1.0.1_darwin-arm64.tar.gz": arc,
+	}
+	f := lock.Fetcher(inner)
+
+	if _, err := f.Fetch(context.Background(), "fs-repo-16-to-17/versions"); err != nil {
+		t.Errorf("unlocked files should be fetched as they are: %s", err)
+	}
+	if _, err := f.Fetch(context.Background(), path); err != nil {
+		t.Errorf("locked archive should be fetched: %s", err)
+	}
+	if _, err := f.Fetch(context.Background(), "fs-repo-16-to-17/v1.0.1/fs-repo-16-to-17_v1.0.1_darwin-arm64.tar.gz"); err == nil {
+		t.Error("expected an error for an archive missing from the lock")
+	}
+
+	inner[path] = []byte("tampered")
+	if _, err := f.Fetch(context.Background(), path); err == nil {
+		t.Error("expected a digest mismatch")
+	}
+}
+
+func TestFetchBinaryLockedArtifact(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("releases are zip archives on windows")
+	}
+	t.Setenv("IPFS_PATH", t.TempDir())
+
+	fetcher := testRelease(t, "v0.36.0", []byte("ipfs"), "")
+	opts := fetchOptions{artifact: &DistArtifact{SHA512: "deadbeef"}}
+	_, _, _, err := fetchBinary(context.Background(), fetcher, "kubo", "v0.36.0", "ipfs", t.TempDir(), opts)
+	if err == nil {
+		t.Error("expected the locked digest to be enforced over dist.json")
+	}
+}
+
+func TestCheckMigrations(t *testing.T) {
+	lock := &ReleaseLock{
+		Version: "v0.37.0",
+		Migrations: []LockedMigration{{
+			Name:     "fs-repo-16-to-17",
+			Version:  "v1.0.1",
+			Archives: map[string]LockedArchive{"linux-amd64": {SHA512: "aa"}},
+		}},
+	}
+	if err := lock.CheckMigrations(16, "linux", "amd64"); err != nil {
+		t.Errorf("expected the locked migration to cover the repo: %s", err)
+	}
+	if err := lock.CheckMigrations(17, "linux", "amd64"); err != nil {
+		t.Errorf("expected no migration to be needed: %s", err)
+	}
+	if err := lock.CheckMigrations(15, "linux", "amd64"); err == nil {
+		t.Error("expected an error for a missing migration")
+	}
+	if err := lock.CheckMigrations(16, "darwin", "arm64"); err == nil {
+		t.Error("expected an error for a platform missing from the migration")
+	}
+}
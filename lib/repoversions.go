@@ -0,0 +1,54 @@
+package lib
+
+import "github.com/blang/semver/v4"
+
+// repoVersions lists the first release of kubo requiring each fs-repo
+// version, oldest first. It must be updated with each kubo release: releases
+// past the minor release of the last entry are not known to this table, as
+// they may require a newer repo version.
+var repoVersions = []struct {
+	since string
+	repo  int
+}{
+	{"0.3.0", 2},
+	{"0.4.0", 3},
+	{"0.4.3", 4},
+	{"0.4.6", 5},
+	{"0.4.11", 6},
+	{"0.4.16", 7},
+	{"0.5.0", 9},
+	{"0.6.0", 10},
+	{"0.8.0", 11},
+	{"0.12.0", 12},
+	{"0.18.0", 13},
+	{"0.21.0", 14},
+	{"0.23.0", 15},
+	{"0.32.0", 16},
+	{"0.37.0", 17},
+}
+
+// RequiredRepoVersion returns the fs-repo version that version vers of kubo
+// requires, according to the releases known to this version of ipfs-update.
+// It returns false for releases older or newer than those.
+func RequiredRepoVersion(vers string) (int, bool) {
+	v, err := semver.ParseTolerant(vers)
+	if err != nil {
+		return 0, false
+	}
+	// release candidates use the repo version of their release
+	v.Pre = nil
+
+	last := semver.MustParse(repoVersions[len(repoVersions)-1].since)
+	if v.Major > last.Major || (v.Major == last.Major && v.Minor > last.Minor) {
+		return 0, false
+	}
+
+	repo := 0
+	for _, rv := range repoVersions {
+		if v.LT(semver.MustParse(rv.since)) {
+			break
+		}
+		repo = rv.repo
+	}
+	return repo, repo != 0
+}
@@ -0,0 +1,211 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/blang/semver/v4"
+	"github.com/ipfs/kubo/repo/fsrepo/migrations"
+)
+
+// ResolveVersion resolves a version expression to a version of kubo. The
+// expression may be:
+//
+//   - an exact version, e.g. "v0.35.0" or "0.35.0-rc1", which is returned as is
+//   - "latest" for the newest stable version, or "beta" for the newest stable
+//     or RC version
+//   - "latest-patch" for the newest patch release of the installed minor version
+//   - "previous" for the newest stable version older than the installed one
+//   - a constraint such as "~0.35", "^0.34.1", "0.36.x" or ">=0.30 <0.35",
+//     which resolves to the newest stable version satisfying it
+//
+// Versions the policy does not permit are skipped.
+func ResolveVersion(ctx context.Context, fetcher migrations.Fetcher, expr string, policy *Policy) (string, error) {
+	if v, ok := exactVersion(expr); ok {
+		return v, nil
+	}
+
+	var current string
+	if expr == "latest-patch" || expr == "previous" {
+		var err error
+		current, err = CurrentIpfsVersion()
+		if err != nil {
+			return "", err
+		}
+		if current == "none" {
+			return "", fmt.Errorf("cannot resolve %q without an installed version", expr)
+		}
+	}
+
+	vs, err := migrations.DistVersions(ctx, fetcher, "kubo", true)
+	if err != nil {
+		return "", err
+	}
+
+	return resolveVersion(expr, vs, current, policy)
+}
+
+// exactVersion returns expr with a "v" prefix if it is a complete version.
+func exactVersion(expr string) (string, bool) {
+	v := strings.TrimPrefix(expr, "v")
+	if _, err := semver.Parse(v); err != nil {
+		return "", false
+	}
+	return "v" + v, true
+}
+
+// resolveVersion returns the first version in vs, which is sorted newest
+// first, that matches expr and is permitted by policy.
+func resolveVersion(expr string, vs []string, current string, policy *Policy) (string, error) {
+	match, stableOnly, err := versionMatcher(expr, current)
+	if err != nil {
+		return "", err
+	}
+
+	for _, v := range vs {
+		sv, err := semver.ParseTolerant(v)
+		if err != nil {
+			continue
+		}
+		if strings.Contains(v, "-dev") {
+			continue
+		}
+		if stableOnly && len(sv.Pre) != 0 {
+			continue
+		}
+		if !match(sv) || policy.Check(v) != nil {
+			continue
+		}
+		return v, nil
+	}
+
+	if policy.Path() != "" {
+		return "", fmt.Errorf("no version matching %q is permitted by policy %s", expr, policy.Path())
+	}
+	return "", fmt.Errorf("no version matching %q found", expr)
+}
+
+// versionMatcher returns a function matching the versions expr refers to, and
+// whether only stable versions should be considered.
+func versionMatcher(expr, current string) (func(semver.Version) bool, bool, error) {
+	switch expr {
+	case "latest":
+		return func(semver.Version) bool { return true }, true, nil
+	case "beta":
+		return func(semver.Version) bool { return true }, false, nil
+	case "latest-patch":
+		cur, err := semver.ParseTolerant(current)
+		if err != nil {
+			return nil, false, err
+		}
+		return func(v semver.Version) bool {
+			return v.Major == cur.Major && v.Minor == cur.Minor && v.GTE(cur)
+		}, true, nil
+	case "previous":
+		cur, err := semver.ParseTolerant(current)
+		if err != nil {
+			return nil, false, err
+		}
+		return func(v semver.Version) bool { return v.LT(cur) }, true, nil
+	}
+
+	var rng semver.Range
+	var err error
+	switch {
+	case strings.HasPrefix(expr, "~"):
+		rng, err = tildeRange(expr[1:])
+	case strings.HasPrefix(expr, "^"):
+		rng, err = caretRange(expr[1:])
+	case isPartialVersion(expr):
+		rng, err = semver.ParseRange(wildcardVersion(expr))
+	default:
+		rng, err = ParseRange(expr)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid version expression %q: %s", expr, err)
+	}
+
+	return rng, true, nil
+}
+
+// isPartialVersion reports whether expr is a version with missing or wildcard
+// components, such as "0.36" or "0.36.x".
+func isPartialVersion(expr string) bool {
+	parts := strings.Split(strings.TrimPrefix(expr, "v"), ".")
+	if len(parts) > 3 {
+		return false
+	}
+	for _, p := range parts {
+		if p == "x" || p == "X" || p == "*" {
+			continue
+		}
+		if p == "" || strings.Trim(p, "0123456789") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// wildcardVersion turns a partial version into the wildcard form understood
+// by semver.ParseRange, e.g. "0.36" into "0.36.x" and "0.x.x" into "0.x".
+func wildcardVersion(expr string) string {
+	parts := strings.Split(strings.TrimPrefix(expr, "v"), ".")
+	for i, p := range parts {
+		if p == "x" || p == "X" || p == "*" {
+			parts[i] = "x"
+			return strings.Join(parts[:i+1], ".")
+		}
+	}
+	if len(parts) < 3 {
+		parts = append(parts, "x")
+	}
+	return strings.Join(parts, ".")
+}
+
+// parsePartial parses a version that may omit the minor and patch numbers,
+// returning the version and how many components were given.
+func parsePartial(s string) (semver.Version, int, error) {
+	s = strings.TrimPrefix(s, "v")
+	n := strings.Count(s, ".") + 1
+	for i := n; i < 3; i++ {
+		s += ".0"
+	}
+	v, err := semver.Parse(s)
+	return v, n, err
+}
+
+// tildeRange returns the range for "~s", which allows patch level changes if
+// a minor version is given, minor level changes otherwise.
+func tildeRange(s string) (semver.Range, error) {
+	v, n, err := parsePartial(s)
+	if err != nil {
+		return nil, err
+	}
+
+	upper := semver.Version{Major: v.Major + 1}
+	if n > 1 {
+		upper = semver.Version{Major: v.Major, Minor: v.Minor + 1}
+	}
+	return semver.ParseRange(fmt.Sprintf(">=%s <%s", v, upper))
+}
+
+// caretRange returns the range for "^s", which allows changes that do not
+// modify the left-most non-zero component.
+func caretRange(s string) (semver.Range, error) {
+	v, _, err := parsePartial(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var upper semver.Version
+	switch {
+	case v.Major > 0:
+		upper = semver.Version{Major: v.Major + 1}
+	case v.Minor > 0:
+		upper = semver.Version{Minor: v.Minor + 1}
+	default:
+		upper = semver.Version{Patch: v.Patch + 1}
+	}
+	return semver.ParseRange(fmt.Sprintf(">=%s <%s", v, upper))
+}
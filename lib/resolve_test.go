@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/blang/semver/v4"
+)
+
+func TestResolveVersion(t *testing.T) {
+	vs := []string{
+		"v0.37.0-rc1",
+		"v0.36.0",
+		"v0.35.1",
+		"v0.35.0",
+		"v0.35.0-rc2",
+		"v0.34.1",
+		"v0.34.0",
+		"v0.33.2",
+		"v0.33.0",
+		"v0.32.0-dev",
+	}
+
+	policy := defaultPolicy()
+	cases := []struct {
+		expr, current, expected string
+	}{
+		{"latest", "", "v0.36.0"},
+		{"beta", "", "v0.37.0-rc1"},
+		{"~0.35", "", "v0.35.1"},
+		{"~0.33.1", "", "v0.33.2"},
+		{"^0.34.0", "", "v0.34.1"},
+		{"0.33.x", "", "v0.33.2"},
+		{"v0.34", "", "v0.34.1"},
+		{"0.x", "", "v0.36.0"},
+		{">=0.33 <0.35", "", "v0.34.1"},
+		{"latest-patch", "v0.35.0", "v0.35.1"},
+		{"latest-patch", "v0.33.0", "v0.33.2"},
+		{"previous", "v0.35.0", "v0.34.1"},
+	}
+	for _, c := range cases {
+		v, err := resolveVersion(c.expr, vs, c.current, policy)
+		if err != nil {
+			t.Errorf("%s: %s", c.expr, err)
+			continue
+		}
+		if v != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.expr, c.expected, v)
+		}
+	}
+
+	for _, expr := range []string{"~0.38", "0.31.x", "foo"} {
+		if v, err := resolveVersion(expr, vs, "", policy); err == nil {
+			t.Errorf("%s: expected error, got %s", expr, v)
+		}
+	}
+
+	policy.deny = append(policy.deny, mustParse(t, "0.36.0"))
+	v, err := resolveVersion("latest", vs, "", policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "v0.35.1" {
+		t.Errorf("expected denied version to be skipped, got %s", v)
+	}
+}
+
+func TestExactVersion(t *testing.T) {
+	for expr, expected := range map[string]string{
+		"0.35.0":     "v0.35.0",
+		"v0.35.0":    "v0.35.0",
+		"0.35.0-rc1": "v0.35.0-rc1",
+		"v0.35":      "",
+		"latest":     "",
+		"~0.35.0":    "",
+		">=0.30.0":   "",
+	} {
+		v, ok := exactVersion(expr)
+		if ok != (expected != "") || v != expected {
+			t.Errorf("%s: expected %q, got %q", expr, expected, v)
+		}
+	}
+}
+
+func mustParse(t *testing.T, s string) semver.Version {
+	t.Helper()
+	v, err := semver.ParseTolerant(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
@@ -2,10 +2,12 @@ package lib
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"text/tabwriter"
 	"time"
 
@@ -14,6 +16,8 @@ import (
 	"github.com/whyrusleeping/stump"
 )
 
+// revertOldBinary puts the binary stashed for version back at oldpath. It is
+// part of rolling back and so cannot be cancelled.
 func revertOldBinary(oldpath, version string) {
 	ipfsDir, err := migrations.CheckIpfsDir("")
 	if err != nil {
@@ -24,7 +28,7 @@ func revertOldBinary(oldpath, version string) {
 	}
 
 	stashpath := filepath.Join(ipfsDir, "old-bin", "ipfs-"+version)
-	err = util.Move(stashpath, oldpath)
+	err = util.Move(context.Background(), stashpath, oldpath)
 	if err != nil {
 		stump.Log("Error reverting")
 		stump.Log("failed to replace binary after install fail:", err)
@@ -34,6 +38,51 @@ func revertOldBinary(oldpath, version string) {
 	}
 }
 
+// StashedBinary is a binary stashed in the old-bin directory.
+type StashedBinary struct {
+	// Tag is the version the binary was stashed from, unless a tag was given
+	// to 'stash'.
+	Tag     string
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// StashedBinaries lists the binaries stashed in the old-bin directory.
+func StashedBinaries() ([]StashedBinary, error) {
+	ipfsDir, err := migrations.CheckIpfsDir("")
+	if err != nil {
+		return nil, err
+	}
+
+	olddir := filepath.Join(ipfsDir, "old-bin")
+	entries, err := os.ReadDir(olddir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var bins []StashedBinary
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "ipfs-") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read fs info about old binary: %s", e.Name())
+		}
+		bins = append(bins, StashedBinary{
+			Tag:     strings.TrimPrefix(e.Name(), "ipfs-"),
+			Path:    filepath.Join(olddir, e.Name()),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+	return bins, nil
+}
+
 func SelectRevertBin() (string, error) {
 	ipfsDir, err := migrations.CheckIpfsDir("")
 	if err != nil {
@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/blang/semver/v4"
+	"github.com/ipfs/kubo/repo/fsrepo/migrations"
+)
+
+// gateTimeout bounds how long fetching a rollout gate over http may take.
+const gateTimeout = 30 * time.Second
+
+// RolloutGate lets fleet operators control an ongoing rollout. It is read
+// from a local file or a URL before every auto update.
+type RolloutGate struct {
+	// Paused stops all auto updates.
+	Paused bool `json:"paused"`
+	// Reason is reported when the rollout is paused.
+	Reason string `json:"reason,omitempty"`
+	// Deny lists versions that must not be rolled out.
+	Deny []string `json:"deny,omitempty"`
+	// Percent limits the rollout to this share of nodes, picked by their peer
+	// id. If nil, all nodes take part.
+	Percent *float64 `json:"percent,omitempty"`
+}
+
+// LoadRolloutGate reads the rollout gate at loc, which is either an http(s)
+// URL or a file path.
+func LoadRolloutGate(ctx context.Context, loc string) (*RolloutGate, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(loc, "http://") || strings.HasPrefix(loc, "https://") {
+		data, err = fetchGate(ctx, loc)
+	} else {
+		data, err = os.ReadFile(loc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read rollout gate: %s", err)
+	}
+
+	g := new(RolloutGate)
+	err = json.Unmarshal(data, g)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rollout gate %s: %s", loc, err)
+	}
+	return g, nil
+}
+
+func fetchGate(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, gateTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// Check returns an error if the gate does not let a node at the given
+// rollout position install vers.
+func (g *RolloutGate) Check(vers string, position float64) error {
+	if g.Paused {
+		if g.Reason != "" {
+			return fmt.Errorf("rollout is paused: %s", g.Reason)
+		}
+		return fmt.Errorf("rollout is paused")
+	}
+
+	v, err := semver.ParseTolerant(vers)
+	if err != nil {
+		return err
+	}
+	for _, d := range g.Deny {
+		dv, err := semver.ParseTolerant(d)
+		if err == nil && v.Equals(dv) {
+			return fmt.Errorf("rollout of %s is blocked", vers)
+		}
+	}
+
+	if g.Percent != nil && position*100 >= *g.Percent {
+		return fmt.Errorf("rollout is limited to %g%% of nodes", *g.Percent)
+	}
+	return nil
+}
+
+// RolloutPosition returns where in a staged rollout of vers the node with
+// the given peer id goes, between 0 (first) and 1 (last). The position is
+// deterministic, but differs between versions so that the same nodes are not
+// always the first to update.
+func RolloutPosition(peerID, vers string) float64 {
+	sum := sha256.Sum256([]byte(peerID + "/" + vers))
+	return float64(binary.BigEndian.Uint64(sum[:8])>>11) / (1 << 53)
+}
+
+// RepoPeerID reads the peer id of the node from the repo config.
+func RepoPeerID() (string, error) {
+	ipfsDir, err := migrations.CheckIpfsDir("")
+	if err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(filepath.Join(ipfsDir, "config"))
+	if err != nil {
+		return "", fmt.Errorf("could not read repo config: %s", err)
+	}
+
+	var cfg struct {
+		Identity struct {
+			PeerID string
+		}
+	}
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return "", fmt.Errorf("could not parse repo config: %s", err)
+	}
+	if cfg.Identity.PeerID == "" {
+		return "", fmt.Errorf("repo config has no peer id")
+	}
+	return cfg.Identity.PeerID, nil
+}
+
+// rolloutDue returns when a node at position may install a version first
+// seen at seen, with the rollout spread over period.
+func rolloutDue(seen time.Time, position float64, period time.Duration) time.Time {
+	return seen.Add(time.Duration(position * float64(period)))
+}
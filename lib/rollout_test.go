@@ -0,0 +1,64 @@
+package lib
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRolloutPosition(t *testing.T) {
+	const peer = "12D3KooWGzxzKZYveHXtpG6AsrUJBcWxHBFS2HsEoGTxrMLvKXtf"
+
+	p := RolloutPosition(peer, "v0.36.0")
+	if p < 0 || p >= 1 {
+		t.Fatalf("position %f out of range", p)
+	}
+	if RolloutPosition(peer, "v0.36.0") != p {
+		t.Error("position is not deterministic")
+	}
+	if RolloutPosition(peer, "v0.36.1") == p {
+		t.Error("position does not depend on the version")
+	}
+
+	// positions should spread evenly across nodes
+	var low int
+	for i := 0; i < 1000; i++ {
+		if RolloutPosition(fmt.Sprintf("peer-%d", i), "v0.36.0") < 0.5 {
+			low++
+		}
+	}
+	if low < 400 || low > 600 {
+		t.Errorf("%d of 1000 positions in the first half", low)
+	}
+}
+
+func TestRolloutDue(t *testing.T) {
+	seen := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	due := rolloutDue(seen, 0.25, 48*time.Hour)
+	if !due.Equal(seen.Add(12 * time.Hour)) {
+		t.Errorf("unexpected due time %s", due)
+	}
+}
+
+func TestRolloutGate(t *testing.T) {
+	percent := 25.0
+	cases := []struct {
+		gate     RolloutGate
+		vers     string
+		position float64
+		allowed  bool
+	}{
+		{RolloutGate{}, "v0.36.0", 0.9, true},
+		{RolloutGate{Paused: true}, "v0.36.0", 0.1, false},
+		{RolloutGate{Deny: []string{"0.36.1"}}, "v0.36.1", 0.1, false},
+		{RolloutGate{Deny: []string{"0.36.1"}}, "v0.36.2", 0.1, true},
+		{RolloutGate{Percent: &percent}, "v0.36.0", 0.2, true},
+		{RolloutGate{Percent: &percent}, "v0.36.0", 0.3, false},
+	}
+	for i, c := range cases {
+		err := c.gate.Check(c.vers, c.position)
+		if (err == nil) != c.allowed {
+			t.Errorf("case %d: expected allowed=%v, got %v", i, c.allowed, err)
+		}
+	}
+}
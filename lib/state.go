@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ipfs/kubo/repo/fsrepo/migrations"
+	"github.com/whyrusleeping/stump"
+)
+
+// stateFile is the name of the file in the ipfs directory the outcome of the
+// last install is recorded in.
+const stateFile = "update-state.json"
+
+// State summarizes the outcome of the last install.
+type State struct {
+	// LastInstall is when the last install finished.
+	LastInstall time.Time `json:"last_install"`
+	// LastVersion is the version the last install tried to install.
+	LastVersion string `json:"last_version"`
+	// LastSucceeded is whether the last install succeeded.
+	LastSucceeded bool `json:"last_succeeded"`
+	// LastMigration is how long the repo migrations of the last install
+	// took, zero if it ran none.
+	LastMigration time.Duration `json:"last_migration_ns"`
+
+	// SeenVersion is the newest version auto updates have found, and SeenAt
+	// when it was first found. Staged rollouts are timed from then.
+	SeenVersion string    `json:"seen_version,omitempty"`
+	SeenAt      time.Time `json:"seen_at"`
+}
+
+// LoadState reads the recorded install state. If nothing was recorded yet, an
+// empty state is returned.
+func LoadState() (*State, error) {
+	ipfsDir, err := migrations.CheckIpfsDir("")
+	if err != nil {
+		return nil, err
+	}
+
+	st := new(State)
+	data, err := os.ReadFile(filepath.Join(ipfsDir, stateFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, st)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// recordState records the outcome of the install in the state file.
+func (i *Install) recordState() {
+	if i.started.IsZero() {
+		return
+	}
+
+	st, err := LoadState()
+	if err != nil {
+		stump.VLog("could not load install state: %s", err)
+		st = new(State)
+	}
+
+	st.LastInstall = time.Now()
+	st.LastVersion = i.targetVers
+	st.LastSucceeded = i.succeeded
+	st.LastMigration = i.migrationTime
+
+	err = saveState(st)
+	if err != nil {
+		stump.VLog("could not record install state: %s", err)
+	}
+}
+
+func saveState(st *State) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	ipfsDir, err := migrations.CheckIpfsDir("")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(ipfsDir, stateFile), data, 0o644)
+}
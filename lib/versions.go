@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os/exec"
 	"strings"
+
+	"github.com/blang/semver/v4"
 )
 
 // CurrentIpfsVersion returns the version of the currently running or installed
@@ -32,3 +34,58 @@ func CurrentIpfsVersion() (string, error) {
 
 	return ver, nil
 }
+
+// VersionFilter selects the versions returned by FilterVersions.
+type VersionFilter struct {
+	// StableOnly skips release candidates and dev versions.
+	StableOnly bool
+	// Since is the oldest version to include.
+	Since string
+	// NewerThan only includes versions newer than this one.
+	NewerThan string
+	// Limit caps the number of versions returned, 0 means no limit.
+	Limit int
+}
+
+// FilterVersions returns the versions in vs selected by f, keeping their
+// order.
+func FilterVersions(vs []string, f VersionFilter) ([]string, error) {
+	var since, newer *semver.Version
+	if f.Since != "" {
+		v, err := semver.ParseTolerant(f.Since)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q: %s", f.Since, err)
+		}
+		since = &v
+	}
+	if f.NewerThan != "" {
+		v, err := semver.ParseTolerant(f.NewerThan)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q: %s", f.NewerThan, err)
+		}
+		newer = &v
+	}
+
+	var out []string
+	for _, ver := range vs {
+		v, err := semver.ParseTolerant(ver)
+		if err != nil {
+			continue
+		}
+		if f.StableOnly && len(v.Pre) != 0 {
+			continue
+		}
+		if since != nil && v.LT(*since) {
+			continue
+		}
+		if newer != nil && v.LTE(*newer) {
+			continue
+		}
+		out = append(out, ver)
+	}
+
+	if f.Limit > 0 && len(out) > f.Limit {
+		out = out[:f.Limit]
+	}
+	return out, nil
+}
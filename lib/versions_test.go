@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilterVersions(t *testing.T) {
+	vs := []string{"v0.36.0", "v0.36.0-rc1", "v0.35.0", "v0.34.1", "v0.33.0"}
+
+	cases := []struct {
+		filter   VersionFilter
+		expected []string
+	}{
+		{VersionFilter{}, vs},
+		{VersionFilter{StableOnly: true}, []string{"v0.36.0", "v0.35.0", "v0.34.1", "v0.33.0"}},
+		{VersionFilter{Since: "v0.34.1"}, []string{"v0.36.0", "v0.36.0-rc1", "v0.35.0", "v0.34.1"}},
+		{VersionFilter{NewerThan: "v0.35.0", StableOnly: true}, []string{"v0.36.0"}},
+		{VersionFilter{StableOnly: true, Limit: 2}, []string{"v0.36.0", "v0.35.0"}},
+	}
+	for _, c := range cases {
+		out, err := FilterVersions(vs, c.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(out, c.expected) {
+			t.Errorf("%+v: expected %v, got %v", c.filter, c.expected, out)
+		}
+	}
+
+	_, err := FilterVersions(vs, VersionFilter{Since: "foo"})
+	if err == nil {
+		t.Fatal("expected error for invalid version")
+	}
+}
+
+func TestRequiredRepoVersion(t *testing.T) {
+	for v, expected := range map[string]int{
+		"v0.4.23":     7,
+		"v0.12.0-rc1": 12,
+		"v0.17.0":     12,
+		"v0.32.1":     16,
+		"v0.37.0":     17,
+		"v0.37.2":     17,
+	} {
+		repo, ok := RequiredRepoVersion(v)
+		if !ok || repo != expected {
+			t.Errorf("%s: expected repo version %d, got %d", v, expected, repo)
+		}
+	}
+
+	if _, ok := RequiredRepoVersion("v0.2.3"); ok {
+		t.Error("expected no repo version for unknown release")
+	}
+	if _, ok := RequiredRepoVersion("v0.38.0"); ok {
+		t.Error("expected no repo version for a release newer than the table")
+	}
+}
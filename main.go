@@ -5,15 +5,23 @@ import (
 	"context"
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
+	"path/filepath"
 	"runtime"
-	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.com/ipfs/go-cid"
 	"github.com/ipfs/ipfs-update/lib"
+	test "github.com/ipfs/ipfs-update/test-dist"
 	"github.com/ipfs/ipfs-update/util"
 	"github.com/ipfs/kubo/repo/fsrepo/migrations"
 
@@ -63,6 +71,41 @@ Otherwise you can close this window.`, exeName, windowsHelpURL)
 			Name:  "distpath",
 			Usage: "specify the distributions build to use",
 		},
+		&cli.StringFlag{
+			Name:  "dist-cid",
+			Usage: "use this snapshot of the distributions build, by its root CID, instead of resolving --distpath.",
+		},
+		&cli.StringFlag{
+			Name:  "policy",
+			Usage: "specify the version policy file to use. Default: $IPFS_PATH/update-policy.json, then /etc/ipfs-update/policy.json",
+		},
+		&cli.StringFlag{
+			Name:  "ipfs-api",
+			Usage: "fetch through the RPC api of this ipfs node instead of the local one, e.g. /dns4/node.internal/tcp/5001/https.",
+		},
+		&cli.StringFlag{
+			Name:    "ipfs-api-auth",
+			EnvVars: []string{"IPFS_API_AUTH"},
+			Usage:   "authenticate to --ipfs-api with this secret, as \"basic:user:password\" or \"bearer:token\".",
+		},
+		&cli.StringSliceFlag{
+			Name:  "mirror",
+			Usage: "also fetch from this HTTP mirror of the dist site, tried after the ipfs node and before the gateway. Mirrors are trusted to serve the latest dist, and cannot be used with --dist-cid or a lock file.",
+		},
+		&cli.IntFlag{
+			Name:  "race",
+			Value: 1,
+			Usage: "fetch from the first `N` sources at once and use the first verified download, instead of trying them in turn.",
+		},
+		&cli.StringFlag{
+			Name:  "max-rate",
+			Usage: "limit the download rate, e.g. \"2MiB/s\".",
+		},
+		&cli.StringFlag{
+			Name:  "progress",
+			Value: "auto",
+			Usage: "how to report download progress on stderr: auto, bar, lines, json or none.",
+		},
 	}
 
 	app.Before = func(c *cli.Context) error {
@@ -77,11 +120,30 @@ Otherwise you can close this window.`, exeName, windowsHelpURL)
 		cmdStash,
 		cmdRevert,
 		cmdFetch,
+		cmdLock,
+		cmdBench,
+		cmdCheck,
+		cmdMetrics,
+		cmdAuto,
+		cmdHistory,
+		cmdRecover,
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// cancel on the first SIGINT or SIGTERM so that downloads stop, test
+	// daemons are killed and a failed install is rolled back; a second
+	// signal exits immediately
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		stump.Log("received %s, stopping (send again to exit immediately)", sig)
+		signal.Stop(sigs)
+		cancel()
+	}()
+
 	if err := app.RunContext(ctx, os.Args); err != nil {
 		stump.Fatal(err)
 	}
@@ -91,18 +153,129 @@ var cmdVersions = &cli.Command{
 	Name:      "versions",
 	Usage:     "Print out all available versions.",
 	ArgsUsage: " ",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "stable-only",
+			Usage: "Only list stable versions.",
+		},
+		&cli.StringFlag{
+			Name:  "since",
+			Usage: "Only list versions since the given one.",
+		},
+		&cli.IntFlag{
+			Name:  "limit",
+			Usage: "Only list the given number of newest versions.",
+		},
+		&cli.BoolFlag{
+			Name:  "newer-than-installed",
+			Usage: "Only list versions newer than the installed one.",
+		},
+		&cli.BoolFlag{
+			Name:    "annotate",
+			Aliases: []string{"a"},
+			Usage:   "Mark installed and stashed versions and show the repo version each version requires.",
+		},
+		&cli.BoolFlag{
+			Name:  "check-builds",
+			Usage: "Also check whether each version has a build for this platform. Makes a request per version.",
+		},
+	},
 	Action: func(c *cli.Context) error {
-		fetcher := createFetcher(c)
+		// keep stdout clean for the versions
+		stump.LogOut = os.Stderr
+
+		fetcher, err := createFetcher(c)
+		if err != nil {
+			stump.Fatal(err)
+		}
 		vs, err := migrations.DistVersions(c.Context, fetcher, "kubo", true)
 		if err != nil {
 			stump.Fatal("failed to query versions:", err)
 		}
 
-		for _, v := range vs {
-			fmt.Println(v)
+		filter := lib.VersionFilter{
+			StableOnly: c.Bool("stable-only"),
+			Since:      c.String("since"),
+			Limit:      c.Int("limit"),
 		}
 
-		return nil
+		annotate := c.Bool("annotate") || c.Bool("check-builds")
+		var installed string
+		if annotate || c.Bool("newer-than-installed") {
+			installed, err = lib.CurrentIpfsVersion()
+			if err != nil {
+				stump.Fatal("failed to check local version:", err)
+			}
+			if installed != "none" && c.Bool("newer-than-installed") {
+				filter.NewerThan = installed
+			}
+		}
+
+		vs, err = lib.FilterVersions(vs, filter)
+		if err != nil {
+			stump.Fatal(err)
+		}
+
+		policy := loadPolicy(c)
+		if !annotate {
+			for _, v := range vs {
+				if policy.Check(v) != nil {
+					fmt.Println(v, "(not allowed by policy)")
+					continue
+				}
+				fmt.Println(v)
+			}
+			return nil
+		}
+
+		stashed := make(map[string]bool)
+		bins, err := lib.StashedBinaries()
+		if err != nil {
+			stump.VLog("could not list stashed binaries:", err)
+		}
+		for _, b := range bins {
+			stashed[b.Tag] = true
+		}
+
+		repoVer, err := migrations.RepoVersion("")
+		if err != nil {
+			repoVer = 0
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 6, 4, 4, ' ', 0)
+		for _, v := range vs {
+			var notes []string
+			if v == installed {
+				notes = append(notes, "installed")
+			}
+			if stashed[v] {
+				notes = append(notes, "stashed")
+			}
+
+			repo := "repo ?"
+			if need, ok := lib.RequiredRepoVersion(v); ok {
+				repo = fmt.Sprintf("repo %d", need)
+				if repoVer != 0 && need != repoVer {
+					notes = append(notes, fmt.Sprintf("migrates repo %d to %d", repoVer, need))
+				}
+			}
+
+			if c.Bool("check-builds") {
+				info, err := lib.FetchDistInfo(c.Context, fetcher, "kubo", v)
+				if err != nil {
+					notes = append(notes, "build unknown")
+				} else if _, ok := info.Artifact(runtime.GOOS, runtime.GOARCH); !ok {
+					notes = append(notes, fmt.Sprintf("no %s/%s build", runtime.GOOS, runtime.GOARCH))
+				}
+			}
+
+			if policy.Check(v) != nil {
+				notes = append(notes, "not allowed by policy")
+			}
+
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", v, repo, strings.Join(notes, ", "))
+		}
+		return tw.Flush()
 	},
 }
 
@@ -124,6 +297,15 @@ var cmdInstall = &cli.Command{
 	Name:      "install",
 	Usage:     "Install a version of ipfs.",
 	ArgsUsage: "A version or \"latest\" for the latest stable version or \"beta\" for the latest stable or RC version",
+	Description: `The version may also be an expression resolving to the newest stable
+   version matching it:
+
+   ~0.35             0.35.x patch releases
+   ^0.34.1           releases compatible with 0.34.1
+   0.36.x            0.36.x patch releases
+   >=0.30 <0.35      any semver range
+   latest-patch      the newest patch release of the installed minor version
+   previous          the newest release older than the installed one`,
 	Flags: []cli.Flag{
 		&cli.BoolFlag{
 			Name:  "no-check",
@@ -133,33 +315,92 @@ var cmdInstall = &cli.Command{
 			Name:  "allow-downgrade",
 			Usage: "Allow downgrading. WARNING: Downgrades may require running reverse migrations.",
 		},
+		&cli.BoolFlag{
+			Name:  "check-gateway",
+			Usage: "Also test fetching content through the HTTP gateway of the new binary.",
+		},
+		&cli.BoolFlag{
+			Name:  "check-api",
+			Usage: "Also test RPC API endpoints of the new binary.",
+		},
+		&cli.BoolFlag{
+			Name:  "check-network",
+			Usage: "Also test that two daemons of the new binary can exchange content over loopback.",
+		},
+		&cli.BoolFlag{
+			Name:  "check-interop",
+			Usage: "Also test that the new binary can exchange content with the currently installed one.",
+		},
+		&cli.StringFlag{
+			Name:  "locked",
+			Usage: "Install exactly the release locked in this `FILE`, written by 'ipfs-update lock'. The version may then be omitted.",
+		},
+		pinFlag,
+		waitFlag,
 	},
 	Action: func(c *cli.Context) error {
 		vers := c.Args().First()
+
+		var lock *lib.ReleaseLock
+		var snapshot string
+		if lockPath := c.String("locked"); lockPath != "" {
+			var err error
+			lock, err = lib.ReadReleaseLock(lockPath)
+			if err != nil {
+				stump.Fatal(err)
+			}
+			if vers != "" && strings.TrimPrefix(vers, "v") != strings.TrimPrefix(lock.Version, "v") {
+				stump.Fatal("version %s does not match the locked version %s", vers, lock.Version)
+			}
+			vers = lock.Version
+			snapshot = lock.DistRoot
+		}
 		if vers == "" {
 			stump.Fatal("please specify a version to install")
 		}
 
-		fetcher := createFetcher(c)
+		unlock := lockUpdates(c)
+		defer unlock()
+		warnInterrupted()
 
-		if vers == "latest" || vers == "beta" {
-			stable := vers == "latest"
-			latest, err := migrations.LatestDistVersion(c.Context, fetcher, "kubo", stable)
+		fetcher, root, err := createFetcherRoot(c, snapshot)
+		if err != nil {
+			stump.Fatal(err)
+		}
+		policy := loadPolicy(c)
+
+		if lock == nil {
+			vers, err = resolveVersion(c.Context, fetcher, vers, policy)
 			if err != nil {
-				stump.Fatal("error resolving %q: %s", vers, err)
+				stump.Fatal(err)
 			}
-			vers = latest
 		}
 
-		vers = checkVersionFormat(vers)
-
 		i := lib.NewInstall(vers, c.Bool("no-check"), c.Bool("allow-downgrade"), fetcher)
-		err := i.Run(c.Context)
+		i.Lock = lock
+		i.Policy = policy
+		i.Checks = test.Checks{
+			Gateway: c.Bool("check-gateway"),
+			API:     c.Bool("check-api"),
+			Network: c.Bool("check-network"),
+		}
+		i.CheckInterop = c.Bool("check-interop")
+		if c.Bool("pin") {
+			i.Pinner = createPinner(c, root)
+			defer i.Pinner.Discard()
+		}
+		err = i.Run(c.Context)
 		if err != nil {
 			return fmt.Errorf("install failed: %s", err)
 		}
 		stump.Log("\nInstallation complete!")
 
+		if i.Pinner != nil {
+			// pinning may take a while, do not hold up other updates
+			unlock()
+			i.Pinner.PinKept(c.Context)
+		}
+
 		_, _, err = lib.ApiShell("")
 		if err == nil {
 			stump.Log("Remember to restart your daemon before continuing.")
@@ -180,8 +421,13 @@ var cmdStash = &cli.Command{
 			Name:  "tag",
 			Usage: "Optionally specify tag for stashed binary.",
 		},
+		waitFlag,
 	},
 	Action: func(c *cli.Context) error {
+		unlock := lockUpdates(c)
+		defer unlock()
+		warnInterrupted()
+
 		tag := c.String("tag")
 		if tag == "" {
 			vers, err := lib.CurrentIpfsVersion()
@@ -191,7 +437,8 @@ var cmdStash = &cli.Command{
 			tag = vers
 		}
 
-		_, err := lib.StashOldBinary(tag, true)
+		_, err := lib.StashOldBinary(c.Context, tag, true)
+		lib.RecordHistory(lib.HistoryEntry{Action: "stash", From: tag}, err)
 		if err != nil {
 			return err
 		}
@@ -213,7 +460,14 @@ var cmdRevert = &cli.Command{
    If multiple previous versions exist, you will be prompted to select the
    desired binary.
 `,
+	Flags: []cli.Flag{
+		waitFlag,
+	},
 	Action: func(c *cli.Context) error {
+		unlock := lockUpdates(c)
+		defer unlock()
+		warnInterrupted()
+
 		oldbinpath, err := lib.SelectRevertBin()
 		if err != nil {
 			return err
@@ -230,7 +484,17 @@ var cmdRevert = &cli.Command{
 		}
 
 		binpath := string(oldpath)
-		err = lib.InstallBinaryTo(oldbinpath, binpath)
+		from, _ := lib.CurrentIpfsVersion()
+		err = lib.InstallBinaryTo(c.Context, oldbinpath, binpath)
+		entry := lib.HistoryEntry{
+			Action: "revert",
+			From:   from,
+			To:     strings.TrimPrefix(filepath.Base(oldbinpath), "ipfs-"),
+		}
+		if err == nil {
+			entry.Digest, _ = lib.FileDigest(binpath)
+		}
+		lib.RecordHistory(entry, err)
 		if err != nil {
 			stump.Error("failed to move old binary: %s", oldbinpath)
 			stump.Error("to path: %s", binpath)
@@ -245,89 +509,899 @@ var cmdFetch = &cli.Command{
 	Name:      "fetch",
 	Usage:     "Fetch a given version of ipfs, or \"latest\" for the latest stable version or \"beta\" for the latest stable or RC version. Default: latest.",
 	ArgsUsage: "<version>",
+	Description: `The version may also be an expression such as ~0.35, ^0.34.1, 0.36.x,
+   latest-patch or previous. See 'ipfs-update install --help'.
+
+   With --os, --arch or --all-platforms, binaries are fetched for other
+   platforms than the current one, into a directory per platform:
+   <output>/<os>-<arch>/ipfs, where output defaults to ipfs-<version>.`,
 	Flags: []cli.Flag{
 		&cli.StringFlag{
 			Name:  "output",
 			Usage: "Specify where to save the downloaded binary.",
 		},
+		&cli.StringFlag{
+			Name:  "os",
+			Usage: "Fetch the binary for this operating system, as named by GOOS, e.g. windows.",
+		},
+		&cli.StringFlag{
+			Name:  "arch",
+			Usage: "Fetch the binary for this architecture, as named by GOARCH, e.g. arm64.",
+		},
+		&cli.BoolFlag{
+			Name:  "all-platforms",
+			Usage: "Fetch the binaries for all the platforms the version was built for, or those matching --os and --arch.",
+		},
+		pinFlag,
 	},
 	Action: func(c *cli.Context) error {
-		fetcher := createFetcher(c)
+		fetcher, root, err := createFetcherRoot(c, "")
+		if err != nil {
+			stump.Fatal(err)
+		}
 
 		vers := c.Args().First()
-		if vers == "" || vers == "latest" || vers == "beta" {
-			var stable bool
-			if vers == "beta" {
-				stump.VLog("looking up 'beta'")
-			} else {
-				vers = "latest"
-				stump.VLog("looking up 'latest'")
-				stable = true
+		if vers == "" {
+			vers = "latest"
+		}
+
+		policy := loadPolicy(c)
+		vers, err = resolveVersion(c.Context, fetcher, vers, policy)
+		if err != nil {
+			stump.Fatal(err)
+		}
+
+		err = policy.Check(vers)
+		if err != nil {
+			stump.Fatal(err)
+		}
+
+		platforms, err := fetchPlatforms(c, fetcher, vers)
+		if err != nil {
+			stump.Fatal(err)
+		}
+
+		fetchBinary := lib.FetchBinaryFor
+		if c.Bool("pin") {
+			pinner := createPinner(c, root)
+			fetchBinary = pinner.FetchBinaryFor
+			// pin what was fetched once done, also if other platforms failed
+			defer pinner.PinKept(c.Context)
+		}
+		fetch := func(p lib.Platform, output string) error {
+			start := time.Now()
+			_, digest, source, err := fetchBinary(c.Context, fetcher, "kubo", vers, "ipfs", output, p)
+			lib.RecordHistory(lib.HistoryEntry{
+				Action:   "fetch",
+				To:       vers,
+				Source:   source,
+				Digest:   digest,
+				Duration: time.Since(start),
+			}, err)
+			return err
+		}
+
+		if platforms == nil {
+			output := c.String("output")
+			if output == "" {
+				output = migrations.ExeName("ipfs-" + vers)
 			}
-			latest, err := migrations.LatestDistVersion(c.Context, fetcher, "kubo", stable)
+
+			stump.Log("fetching kubo version", vers)
+			err = fetch(lib.CurrentPlatform(), output)
 			if err != nil {
-				stump.Fatal("error querying %q version: %s", vers, err)
+				return cli.Exit(fmt.Sprintf("failed to fetch binary: %s", err), 1)
 			}
+			return nil
+		}
 
-			vers = latest
+		dir := c.String("output")
+		if dir == "" {
+			dir = "ipfs-" + vers
 		}
+		var failed int
+		for _, p := range platforms {
+			pdir := filepath.Join(dir, p.String())
+			err = os.MkdirAll(pdir, 0o755)
+			if err == nil {
+				stump.Log("fetching kubo version %s for %s", vers, p)
+				err = fetch(p, pdir)
+			}
+			if err != nil {
+				stump.Error("failed to fetch binary for %s: %s", p, err)
+				failed++
+			}
+		}
+		if failed != 0 {
+			return cli.Exit(fmt.Sprintf("failed to fetch %d of %d binaries", failed, len(platforms)), 1)
+		}
+		return nil
+	},
+}
 
-		vers = checkVersionFormat(vers)
+// fetchPlatforms returns the platforms to fetch vers for, given by the --os,
+// --arch and --all-platforms flags, or nil if none is set and vers is fetched
+// for the current platform only.
+func fetchPlatforms(c *cli.Context, fetcher migrations.Fetcher, vers string) ([]lib.Platform, error) {
+	goos, goarch := c.String("os"), c.String("arch")
+	if !c.Bool("all-platforms") {
+		if goos == "" && goarch == "" {
+			return nil, nil
+		}
+		p := lib.CurrentPlatform()
+		if goos != "" {
+			p.OS = goos
+		}
+		if goarch != "" {
+			p.Arch = goarch
+		}
+		return []lib.Platform{p}, nil
+	}
 
-		var err error
-		output := c.String("output")
-		if output == "" {
-			output = migrations.ExeName("ipfs-" + vers)
+	info, err := lib.FetchDistInfo(c.Context, fetcher, "kubo", vers)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list the platforms of %s: %s", vers, err)
+	}
+	var platforms []lib.Platform
+	for _, p := range info.Builds() {
+		if (goos == "" || p.OS == goos) && (goarch == "" || p.Arch == goarch) {
+			platforms = append(platforms, p)
 		}
+	}
+	if len(platforms) == 0 {
+		return nil, fmt.Errorf("%s was not built for any matching platform", vers)
+	}
+	return platforms, nil
+}
 
-		stump.Log("fetching kubo version", vers)
+var cmdLock = &cli.Command{
+	Name:      "lock",
+	Usage:     "Write a lock file pinning a version of ipfs, for reproducible installs.",
+	ArgsUsage: "<version>",
+	Description: `'lock' resolves the version and the dist site, and writes to the lock file
+   the root CID of that snapshot of the dist site, the version, the digests of
+   its archives for every platform and the repo migrations it needs, with
+   their digests. 'ipfs-update install --locked' then installs exactly those
+   archives, or fails.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "output",
+			Value: "ipfs-update.lock",
+			Usage: "Specify where to write the lock file.",
+		},
+		&cli.IntFlag{
+			Name:  "from-repo",
+			Usage: "Lock the migrations needed by a repo of this version. Default: the version of the local repo, if there is one. 0 locks no migrations.",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		vers := c.Args().First()
+		if vers == "" {
+			stump.Fatal("please specify a version to lock")
+		}
 
-		_, err = migrations.FetchBinary(c.Context, fetcher, "kubo", vers, "ipfs", output)
+		fetcher, root, err := createFetcherRoot(c, "")
+		if err != nil {
+			stump.Fatal(err)
+		}
+		policy := loadPolicy(c)
+		vers, err = resolveVersion(c.Context, fetcher, vers, policy)
 		if err != nil {
-			stump.Fatal("failed to fetch binary:", err)
+			stump.Fatal(err)
+		}
+		err = policy.Check(vers)
+		if err != nil {
+			stump.Fatal(err)
+		}
+
+		fromRepo := c.Int("from-repo")
+		if !c.IsSet("from-repo") {
+			fromRepo, err = migrations.RepoVersion("")
+			if err != nil {
+				fromRepo = 0
+			}
 		}
 
+		lock, err := lib.CreateReleaseLock(c.Context, fetcher, root.Path(c.Context), vers, fromRepo)
+		if err != nil {
+			stump.Fatal("failed to lock release:", err)
+		}
+		err = lock.Write(c.String("output"))
+		if err != nil {
+			stump.Fatal("failed to write lock file:", err)
+		}
+
+		stump.Log("locked kubo %s at %s for %s", lock.Version, lock.DistRoot, strings.Join(lock.Platforms(), ", "))
+		for _, m := range lock.Migrations {
+			stump.Log("  with migration %s %s", m.Name, m.Version)
+		}
 		return nil
 	},
 }
 
-func checkVersionFormat(ver string) string {
-	if !strings.HasPrefix(ver, "v") && looksLikeSemver(ver) {
-		stump.VLog("Version strings must start with 'v'. Autocorrecting...")
-		ver = "v" + ver
+var cmdBench = &cli.Command{
+	Name:      "bench",
+	Usage:     "Compare the performance of two versions of ipfs.",
+	ArgsUsage: "<versionA> <versionB>",
+	Description: `'bench' fetches both versions and runs the same local workload against
+   each of them in a throwaway repo: daemon startup, adding and reading back
+   random data, listing local refs and the memory used by the idle daemon.`,
+	Flags: []cli.Flag{
+		&cli.Int64Flag{
+			Name:  "size",
+			Usage: "Amount of random data to add, in MiB.",
+			Value: 64,
+		},
+		&cli.DurationFlag{
+			Name:  "idle",
+			Usage: "How long to let the daemon idle before measuring its memory use.",
+			Value: 10 * time.Second,
+		},
+		&cli.IntFlag{
+			Name:  "runs",
+			Usage: "Number of times to run the workload. The median is reported.",
+			Value: 3,
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print results as JSON.",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 2 {
+			stump.Fatal("please specify two versions to compare")
+		}
+
+		if c.Bool("json") {
+			// keep stdout clean for the results
+			stump.LogOut = os.Stderr
+		}
+
+		fetcher, err := createFetcher(c)
+		if err != nil {
+			return err
+		}
+
+		tmpd, err := os.MkdirTemp("", "ipfs-update-bench")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpd)
+
+		opts := test.BenchOptions{
+			Size: c.Int64("size") * 1024 * 1024,
+			Idle: c.Duration("idle"),
+			Runs: c.Int("runs"),
+		}
+
+		policy := loadPolicy(c)
+
+		var results []*test.BenchResult
+		for _, arg := range c.Args().Slice() {
+			vers, err := resolveVersion(c.Context, fetcher, arg, policy)
+			if err != nil {
+				stump.Fatal(err)
+			}
+
+			stump.Log("fetching kubo version", vers)
+			bin, err := lib.FetchBinary(c.Context, fetcher, "kubo", vers, "ipfs", filepath.Join(tmpd, migrations.ExeName("ipfs-"+vers)))
+			if err != nil {
+				stump.Fatal("failed to fetch binary:", err)
+			}
+
+			res, err := test.Bench(c.Context, bin, vers, opts)
+			if err != nil {
+				return fmt.Errorf("benchmarking %s failed: %s", vers, err)
+			}
+			results = append(results, res)
+		}
+
+		if c.Bool("json") {
+			out := struct {
+				Size    int64               `json:"size_bytes"`
+				Runs    int                 `json:"runs"`
+				Results []*test.BenchResult `json:"results"`
+			}{opts.Size, opts.Runs, results}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(out)
+		}
+
+		a, b := results[0], results[1]
+		change := func(x, y int64) string {
+			if x == 0 {
+				return "-"
+			}
+			return fmt.Sprintf("%+.1f%%", float64(y-x)/float64(x)*100)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 6, 4, 4, ' ', 0)
+		fmt.Fprintf(tw, "\t%s\t%s\tchange\n", a.Version, b.Version)
+		for _, row := range []struct {
+			name string
+			a, b time.Duration
+		}{
+			{"startup", a.Startup, b.Startup},
+			{"add " + util.HumanBytes(opts.Size), a.Add, b.Add},
+			{"cat " + util.HumanBytes(opts.Size), a.Cat, b.Cat},
+			{"refs local", a.RefsLocal, b.RefsLocal},
+		} {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", row.name, row.a.Round(time.Millisecond), row.b.Round(time.Millisecond), change(int64(row.a), int64(row.b)))
+		}
+		fmt.Fprintf(tw, "idle rss\t%s\t%s\t%s\n", util.HumanBytes(a.IdleRSS), util.HumanBytes(b.IdleRSS), change(a.IdleRSS, b.IdleRSS))
+		return tw.Flush()
+	},
+}
+
+// Exit codes of the check command.
+const (
+	checkUpToDate = 0
+	checkError    = 2
+	checkPatch    = 10
+	checkMinor    = 11
+	checkMajor    = 12
+)
+
+var cmdCheck = &cli.Command{
+	Name:    "check",
+	Aliases: []string{"outdated"},
+	Usage:   "Check whether a newer version of ipfs is available.",
+	Description: `'check' compares the installed version of ipfs with the latest stable
+   version permitted by the version policy, and exits with:
+
+   0   the installed version is up to date
+   2   the check failed
+   10  a patch release is available
+   11  a minor release is available
+   12  a major release, or one requiring a repo migration, is available`,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the result as JSON.",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.Bool("json") {
+			// keep stdout clean for the result
+			stump.LogOut = os.Stderr
+		}
+
+		installed, err := lib.CurrentIpfsVersion()
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("failed to check local version: %s", err), checkError)
+		}
+		if installed == "none" {
+			return cli.Exit("no ipfs installation found", checkError)
+		}
+
+		policy, err := lib.LoadPolicy(c.String("policy"))
+		if err != nil {
+			return cli.Exit(err, checkError)
+		}
+
+		fetcher, err := createFetcher(c)
+		if err != nil {
+			return cli.Exit(err, checkError)
+		}
+		latest, err := lib.ResolveVersion(c.Context, fetcher, "latest", policy)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("failed to query latest version: %s", err), checkError)
+		}
+
+		update, err := lib.ClassifyUpdate(installed, latest)
+		if err != nil {
+			return cli.Exit(err, checkError)
+		}
+
+		code := map[lib.Update]int{
+			lib.UpToDate:    checkUpToDate,
+			lib.PatchUpdate: checkPatch,
+			lib.MinorUpdate: checkMinor,
+			lib.MajorUpdate: checkMajor,
+		}[update]
+
+		if c.Bool("json") {
+			out := struct {
+				Installed string `json:"installed"`
+				Latest    string `json:"latest"`
+				Update    string `json:"update"`
+				ExitCode  int    `json:"exit_code"`
+			}{installed, latest, update.String(), code}
+			err = json.NewEncoder(os.Stdout).Encode(out)
+			if err != nil {
+				return cli.Exit(err, checkError)
+			}
+		} else if update == lib.UpToDate {
+			fmt.Printf("OK: kubo %s is up to date\n", installed)
+		} else {
+			fmt.Printf("WARNING: %s update available: kubo %s -> %s\n", update, installed, latest)
+		}
+
+		if code == checkUpToDate {
+			return nil
+		}
+		return cli.Exit("", code)
+	},
+}
+
+var cmdMetrics = &cli.Command{
+	Name:  "metrics",
+	Usage: "Export the update state of ipfs as prometheus metrics.",
+	Description: `'metrics' reports the installed and latest versions of ipfs, the repo
+   version, the stashed binaries and the outcome of the last install in the
+   prometheus text format.
+
+   With --textfile, the metrics are written to the given file for the textfile
+   collector of the node exporter, e.g. from a cron job. The file is replaced
+   atomically.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "textfile",
+			Usage: "Write the metrics to this file instead of stdout.",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		textfile := c.String("textfile")
+		if textfile == "" {
+			// keep stdout clean for the metrics
+			stump.LogOut = os.Stderr
+		}
+
+		fetcher, err := createFetcher(c)
+		if err != nil {
+			return err
+		}
+		m, err := lib.GatherMetrics(c.Context, fetcher, loadPolicy(c))
+		if err != nil {
+			return fmt.Errorf("failed to gather metrics: %s", err)
+		}
+
+		if textfile == "" {
+			return m.Write(os.Stdout)
+		}
+
+		err = m.WriteTextfile(textfile)
+		if err != nil {
+			return fmt.Errorf("failed to write metrics: %s", err)
+		}
+		stump.VLog("wrote metrics to %s", textfile)
+		return nil
+	},
+}
+
+var cmdAuto = &cli.Command{
+	Name:  "auto",
+	Usage: "Install new versions of ipfs unattended.",
+	Description: `'auto' periodically checks for a new version permitted by the version
+   policy. When one is found, it is downloaded and verified right away, then
+   installed during the maintenance window. A running daemon is stopped for
+   the install and restarted afterwards. If the restarted daemon does not come
+   up running the new version within --health-timeout, the previous binary is
+   put back and the repo migrated back.
+
+   By default only patch releases are installed. With --once, a single check
+   is made, for running from cron or a systemd timer.
+
+   With --rollout-period, each node waits a delay between zero and the period,
+   derived from its peer id, after first finding a new version, so that a fleet
+   does not update all at once. --rollout-gate names a JSON file or URL that is
+   read before downloading and again before installing:
+
+   {"paused": true, "reason": "bad release", "deny": ["v0.36.1"], "percent": 25}
+
+   "paused" stops the rollout, "deny" blocks versions and "percent" limits it
+   to that share of nodes. If the gate cannot be read, nothing is installed.
+
+   Example:
+
+   ipfs-update auto --window 02:00-04:00 \
+     --stop-cmd "systemctl stop ipfs" --start-cmd "systemctl start ipfs"`,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "once",
+			Usage: "Check for an update once and exit.",
+		},
+		&cli.DurationFlag{
+			Name:  "interval",
+			Usage: "How often to check for updates.",
+			Value: 6 * time.Hour,
+		},
+		&cli.StringFlag{
+			Name:  "max-update",
+			Usage: "Largest kind of update to install: patch, minor or major.",
+			Value: "patch",
+		},
+		&cli.StringFlag{
+			Name:  "window",
+			Usage: "Daily maintenance window in local time, e.g. 02:00-04:00.",
+		},
+		&cli.StringFlag{
+			Name:  "stop-cmd",
+			Usage: "Shell command stopping the daemon. Defaults to shutting it down through its api.",
+		},
+		&cli.StringFlag{
+			Name:  "start-cmd",
+			Usage: "Shell command starting the daemon. Required if a daemon is running.",
+		},
+		&cli.DurationFlag{
+			Name:  "health-timeout",
+			Usage: "How long the restarted daemon may take to come up before the update is reverted.",
+			Value: 2 * time.Minute,
+		},
+		&cli.DurationFlag{
+			Name:  "rollout-period",
+			Usage: "Spread installs of a new version across nodes over this period, based on their peer id.",
+		},
+		&cli.StringFlag{
+			Name:  "rollout-gate",
+			Usage: "File or URL of a rollout gate that can pause or limit the rollout.",
+		},
+		&cli.BoolFlag{
+			Name:  "check-gateway",
+			Usage: "Also test fetching content through the HTTP gateway of the new binary.",
+		},
+		&cli.BoolFlag{
+			Name:  "check-api",
+			Usage: "Also test RPC API endpoints of the new binary.",
+		},
+		&cli.BoolFlag{
+			Name:  "check-network",
+			Usage: "Also test that two daemons of the new binary can exchange content over loopback.",
+		},
+		waitFlag,
+	},
+	Action: func(c *cli.Context) error {
+		fetcher, root, err := createFetcherRoot(c, "")
+		if err != nil {
+			return err
+		}
+		a := lib.NewAutoUpdate(fetcher)
+		a.DistRoot = root
+		a.LockWait = c.Duration("wait")
+		a.Policy = loadPolicy(c)
+		a.StopCmd = c.String("stop-cmd")
+		a.StartCmd = c.String("start-cmd")
+		a.HealthTimeout = c.Duration("health-timeout")
+		a.RolloutPeriod = c.Duration("rollout-period")
+		a.RolloutGate = c.String("rollout-gate")
+		a.Checks = test.Checks{
+			Gateway: c.Bool("check-gateway"),
+			API:     c.Bool("check-api"),
+			Network: c.Bool("check-network"),
+		}
+
+		a.MaxUpdate, err = lib.ParseUpdate(c.String("max-update"))
+		if err != nil || a.MaxUpdate == lib.UpToDate {
+			return fmt.Errorf("invalid --max-update %q, expected patch, minor or major", c.String("max-update"))
+		}
+
+		if w := c.String("window"); w != "" {
+			a.Window, err = lib.ParseWindow(w)
+			if err != nil {
+				return err
+			}
+		}
+
+		if c.Bool("once") {
+			err = a.RunOnce(c.Context)
+			if err != nil {
+				return fmt.Errorf("auto update failed: %s", err)
+			}
+			return nil
+		}
+
+		if c.Duration("interval") <= 0 {
+			return fmt.Errorf("--interval must be positive")
+		}
+		return a.Run(c.Context, c.Duration("interval"))
+	},
+}
+
+var cmdHistory = &cli.Command{
+	Name:  "history",
+	Usage: "Show the log of installs, fetches, stashes, reverts and migrations.",
+	Description: `'history' prints the entries of $IPFS_PATH/update-history.log, which
+   records who ran what, when, from which source and with which outcome.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "action",
+			Usage: "Only show entries for this action: install, fetch, stash, revert or migrate.",
+		},
+		&cli.BoolFlag{
+			Name:  "failed",
+			Usage: "Only show failed actions.",
+		},
+		&cli.IntFlag{
+			Name:  "limit",
+			Usage: "Show at most this many of the most recent entries, 0 for all.",
+			Value: 20,
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the entries as JSON lines.",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		entries, err := lib.ReadHistory()
+		if err != nil {
+			return fmt.Errorf("could not read history: %s", err)
+		}
+
+		var sel []lib.HistoryEntry
+		for _, e := range entries {
+			if a := c.String("action"); a != "" && e.Action != a {
+				continue
+			}
+			if c.Bool("failed") && e.Success {
+				continue
+			}
+			sel = append(sel, e)
+		}
+		if n := c.Int("limit"); n > 0 && len(sel) > n {
+			sel = sel[len(sel)-n:]
+		}
+
+		if c.Bool("json") {
+			enc := json.NewEncoder(os.Stdout)
+			for _, e := range sel {
+				err = enc.Encode(e)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		if len(sel) == 0 {
+			stump.Log("no history recorded")
+			return nil
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 6, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "TIME\tUSER\tACTION\tFROM\tTO\tDURATION\tSOURCE\tRESULT")
+		for _, e := range sel {
+			result := "ok"
+			if !e.Success {
+				result = "failed: " + e.Error
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				e.Time.Local().Format("2006-01-02 15:04:05"), e.User, e.Action,
+				orDash(e.From), orDash(e.To), e.Duration.Round(time.Millisecond),
+				orDash(e.Source), result)
+		}
+		return tw.Flush()
+	},
+}
+
+// orDash returns s, or "-" if it is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
 	}
-	return ver
+	return s
+}
+
+var cmdRecover = &cli.Command{
+	Name:  "recover",
+	Usage: "Complete or roll back an interrupted install.",
+	Description: `Installs keep a journal of their progress in $IPFS_PATH/update-journal.json.
+   If ipfs-update is killed during an install, 'recover' picks it up: if the
+   new binary was verified and is still available, the install is completed,
+   otherwise the previous binary is restored and the repo migrated back.`,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "rollback",
+			Usage: "Always roll back the interrupted install.",
+		},
+		waitFlag,
+	},
+	Action: func(c *cli.Context) error {
+		unlock := lockUpdates(c)
+		defer unlock()
+
+		j, err := lib.LoadJournal()
+		if err != nil {
+			return fmt.Errorf("could not read install journal: %s", err)
+		}
+		if j == nil {
+			stump.Log("no interrupted install found")
+			return nil
+		}
+
+		stump.Log("found install of %s over %s interrupted at phase %q (started %s)",
+			j.To, j.From, j.Phase, j.Started.Format(time.RFC3339))
+		fetcher, err := createFetcher(c)
+		if err != nil {
+			return err
+		}
+		err = lib.Recover(c.Context, j, fetcher, c.Bool("rollback"))
+		if err != nil {
+			return fmt.Errorf("recovery failed: %s", err)
+		}
+		stump.Log("\nRecovery complete.")
+		return nil
+	},
 }
 
-func looksLikeSemver(v string) bool {
-	parts := strings.Split(v, ".")
-	if len(parts) < 3 {
-		return false
+// waitFlag is shared by the commands taking the update lock.
+var waitFlag = &cli.DurationFlag{
+	Name:  "wait",
+	Usage: "If another update is in progress, wait up to this long for it to finish.",
+}
+
+// pinFlag is shared by the commands downloading a release.
+var pinFlag = &cli.BoolFlag{
+	Name:  "pin",
+	Usage: "Pin the downloaded archive into the local ipfs node, so that other nodes can fetch it from this one.",
+}
+
+// lockUpdates takes the update lock, waiting as long as the --wait flag
+// allows, and returns a function releasing it, which may be called again.
+func lockUpdates(c *cli.Context) func() {
+	l, err := lib.AcquireLock(c.Context, c.Duration("wait"))
+	if err != nil {
+		stump.Fatal(err)
 	}
+	return sync.OnceFunc(func() {
+		l.Close()
+	})
+}
 
-	if _, err := strconv.Atoi(parts[0]); err == nil {
-		return true
+// warnInterrupted warns about an interrupted install. It must be called with
+// the update lock held, as the journal of a running install is not an
+// interrupted one, and probing the lock would get in the way of that install.
+func warnInterrupted() {
+	j, err := lib.LoadJournal()
+	if err == nil && j != nil {
+		stump.Error("an install of %s was interrupted at phase %q, run 'ipfs-update recover'", j.To, j.Phase)
 	}
+}
 
-	return false
+// resolveVersion resolves a version expression given on the command line and
+// reports what it resolved to.
+func resolveVersion(ctx context.Context, fetcher migrations.Fetcher, expr string, policy *lib.Policy) (string, error) {
+	vers, err := lib.ResolveVersion(ctx, fetcher, expr, policy)
+	if err != nil {
+		return "", fmt.Errorf("error resolving %q: %s", expr, err)
+	}
+	if strings.TrimPrefix(vers, "v") != strings.TrimPrefix(expr, "v") {
+		stump.Log("resolved %q to %s", expr, vers)
+	}
+	return vers, nil
 }
 
-func createFetcher(c *cli.Context) migrations.Fetcher {
-	const userAgent = "ipfs-update"
+// loadPolicy loads the version policy selected by the --policy flag.
+func loadPolicy(c *cli.Context) *lib.Policy {
+	policy, err := lib.LoadPolicy(c.String("policy"))
+	if err != nil {
+		stump.Fatal(err)
+	}
+	if policy.Path() != "" {
+		stump.VLog("using version policy %s", policy.Path())
+	}
+	return policy
+}
+
+// createDistRoot returns the root of the distribution site: snapshot if not
+// empty, else given by --dist-cid, or else resolved from --distpath by
+// resolvers.
+func createDistRoot(c *cli.Context, snapshot string, resolvers ...lib.PathResolver) (*lib.DistRoot, error) {
+	if c.IsSet("distpath") && c.IsSet("dist-cid") {
+		return nil, errors.New("--distpath and --dist-cid cannot be used together")
+	}
+	if snapshot != "" {
+		if c.IsSet("distpath") || c.IsSet("dist-cid") {
+			return nil, errors.New("the lock file sets the dist root, --distpath and --dist-cid cannot be used with it")
+		}
+		return lib.NewDistRoot(snapshot), nil
+	}
+	if s := c.String("dist-cid"); s != "" {
+		id, err := cid.Decode(strings.TrimPrefix(s, "/ipfs/"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid --dist-cid: %s", err)
+		}
+		return lib.NewDistRoot("/ipfs/" + id.String()), nil
+	}
 
 	distPath := c.String("distpath")
 	if distPath == "" {
 		distPath = migrations.GetDistPathEnv("")
 	}
+	return lib.NewDistRoot(distPath, resolvers...), nil
+}
+
+// createPinner sets up pinning of downloaded archives into the local node,
+// under the same snapshot of the dist site they were fetched from.
+func createPinner(c *cli.Context, root *lib.DistRoot) *lib.Pinner {
+	return &lib.Pinner{DistPath: root.Path(c.Context)}
+}
+
+func createFetcher(c *cli.Context) (migrations.Fetcher, error) {
+	fetcher, _, err := createFetcherRoot(c, "")
+	return fetcher, err
+}
+
+// createFetcherRoot creates the fetcher, and returns with it the root of the
+// distribution site it fetches from. If snapshot is not empty, it is the
+// root, e.g. the one of a lock file.
+func createFetcherRoot(c *cli.Context, snapshot string) (migrations.Fetcher, *lib.DistRoot, error) {
+	const userAgent = "ipfs-update"
 
 	customIpfsGatewayURL := os.Getenv("IPFS_GATEWAY") // uses https://ipfs.io as default, if unset
+	gatewayName := customIpfsGatewayURL
+	if gatewayName == "" {
+		gatewayName = "https://ipfs.io"
+	}
+
+	transfers, err := createTransfers(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	ipfsFetcher := lib.NewIpfsFetcher("", 0)
+	ipfsFetcher.Transfers = transfers
+	ipfsFetcher.ApiAddr = c.String("ipfs-api")
+	ipfsFetcher.ApiAuth = c.String("ipfs-api-auth")
+
+	httpFetcher := lib.NewHttpFetcher("", customIpfsGatewayURL, userAgent, 0)
+	httpFetcher.Transfers = transfers
 
-	return migrations.NewMultiFetcher(
-		lib.NewIpfsFetcher(distPath, 0),
-		&migrations.RetryFetcher{
-			Fetcher:  migrations.NewHttpFetcher(distPath, customIpfsGatewayURL, userAgent, 0),
+	// resolve the dist path once, so that all files come from one snapshot
+	root, err := createDistRoot(c, snapshot, ipfsFetcher, lib.DNSLinkResolver{}, httpFetcher)
+	if err != nil {
+		return nil, nil, err
+	}
+	ipfsFetcher.Root = root
+	httpFetcher.Root = root
+
+	fetchers := []migrations.Fetcher{lib.TrackSource(ipfsFetcher.Source(), ipfsFetcher)}
+
+	// mirrors are copies of the dist site, so the dist path does not apply,
+	// and neither does a snapshot of it
+	mirrors := c.StringSlice("mirror")
+	if len(mirrors) > 0 && (snapshot != "" || c.IsSet("dist-cid")) {
+		return nil, nil, errors.New("--mirror cannot be used with --dist-cid or a lock file, mirrors only serve the latest dist")
+	}
+	for _, mirror := range mirrors {
+		mirrorFetcher := lib.NewHttpFetcher("/", mirror, userAgent, 0)
+		mirrorFetcher.Transfers = transfers
+		fetchers = append(fetchers, lib.TrackSource(mirror, &migrations.RetryFetcher{
+			Fetcher:  mirrorFetcher,
 			MaxTries: 3,
-		})
+		}))
+	}
+
+	fetchers = append(fetchers, lib.TrackSource(gatewayName, &migrations.RetryFetcher{
+		Fetcher:  httpFetcher,
+		MaxTries: 3,
+	}))
+
+	if n := c.Int("race"); n > 1 {
+		return lib.NewRaceFetcher(n, fetchers...), root, nil
+	}
+	return migrations.NewMultiFetcher(fetchers...), root, nil
+}
+
+// createTransfers sets up progress reporting and rate limiting of downloads
+// from the --progress and --max-rate flags.
+func createTransfers(c *cli.Context) (lib.Transfers, error) {
+	var ts lib.Transfers
+
+	progress, err := lib.NewProgress(c.String("progress"), os.Stderr)
+	if err != nil {
+		return ts, err
+	}
+	ts.Progress = progress
+
+	if r := c.String("max-rate"); r != "" {
+		rate, err := util.ParseRate(r)
+		if err != nil {
+			return ts, fmt.Errorf("invalid --max-rate: %s", err)
+		}
+		if rate <= 0 {
+			return ts, errors.New("--max-rate must be positive")
+		}
+		ts.Limiter = util.NewRateLimiter(rate)
+	}
+	return ts, nil
 }
 
 func readCurrentVersionNumberFromEmbed(versionFile []byte) string {
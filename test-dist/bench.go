@@ -0,0 +1,222 @@
+package testdist
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	util "github.com/ipfs/ipfs-update/util"
+	stump "github.com/whyrusleeping/stump"
+)
+
+// benchSeed seeds the data added by Bench so every binary gets the same
+// workload and produces the same CIDs.
+const benchSeed = 4242
+
+// startupTimeout bounds how long a benchmarked daemon may take to come online.
+const startupTimeout = 2 * time.Minute
+
+// BenchOptions configures the workload run by Bench.
+type BenchOptions struct {
+	// Size is the amount of random data added and read back, in bytes.
+	Size int64
+	// Idle is how long the daemon sits idle before its memory use is sampled.
+	Idle time.Duration
+	// Runs is how many times the workload is repeated. The median of each
+	// measurement is reported.
+	Runs int
+}
+
+// BenchResult holds the measurements Bench took for a binary.
+type BenchResult struct {
+	Version   string        `json:"version"`
+	Startup   time.Duration `json:"startup_ns"`
+	Add       time.Duration `json:"add_ns"`
+	Cat       time.Duration `json:"cat_ns"`
+	RefsLocal time.Duration `json:"refs_local_ns"`
+	// IdleRSS is the resident memory of the daemon after idling, in bytes.
+	// It is 0 when it could not be measured on this platform.
+	IdleRSS int64 `json:"idle_rss_bytes"`
+}
+
+// Bench runs a local workload against bin in a staging repo and reports how
+// long each step took.
+func Bench(ctx context.Context, bin, version string, opts BenchOptions) (*BenchResult, error) {
+	if opts.Runs < 1 {
+		opts.Runs = 1
+	}
+
+	err := os.Chmod(bin, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	staging, err := stagingDir()
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make([]*BenchResult, 0, opts.Runs)
+	for i := 0; i < opts.Runs; i++ {
+		stump.Log("benchmarking %s (run %d of %d)", version, i+1, opts.Runs)
+		r, err := benchRun(ctx, staging, bin, opts)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+
+	res := &BenchResult{
+		Version:   version,
+		Startup:   time.Duration(median(runs, func(r *BenchResult) int64 { return int64(r.Startup) })),
+		Add:       time.Duration(median(runs, func(r *BenchResult) int64 { return int64(r.Add) })),
+		Cat:       time.Duration(median(runs, func(r *BenchResult) int64 { return int64(r.Cat) })),
+		RefsLocal: time.Duration(median(runs, func(r *BenchResult) int64 { return int64(r.RefsLocal) })),
+		IdleRSS:   median(runs, func(r *BenchResult) int64 { return r.IdleRSS }),
+	}
+	return res, nil
+}
+
+func benchRun(ctx context.Context, staging, bin string, opts BenchOptions) (*BenchResult, error) {
+	tdir, err := os.MkdirTemp(staging, "bench")
+	if err != nil {
+		return nil, err
+	}
+	defer func(dir string) {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			stump.Error("error cleaning up staging directory: ", err)
+		}
+	}(tdir)
+
+	_, err = runCmd(ctx, tdir, bin, "init")
+	if err != nil {
+		return nil, fmt.Errorf("error initializing with binary: %s", err)
+	}
+
+	err = tweakConfig(tdir, Checks{})
+	if err != nil {
+		return nil, err
+	}
+
+	dataFile := filepath.Join(tdir, "bench.bin")
+	err = writeBenchData(dataFile, opts.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	res := new(BenchResult)
+
+	stump.VLog("  - starting up daemon")
+	start := time.Now()
+	d, err := spawnDaemon(ctx, tdir, bin)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	err = pollApi(ctx, tdir, startupTimeout)
+	if err != nil {
+		return nil, err
+	}
+	res.Startup = time.Since(start)
+
+	node := &testNode{dir: tdir, bin: bin}
+
+	stump.VLog("  - adding %s", util.HumanBytes(opts.Size))
+	start = time.Now()
+	hash, err := runCmd(ctx, tdir, bin, "add", "-q", "--progress=false", dataFile)
+	if err != nil {
+		return nil, fmt.Errorf("add failed: %s", err)
+	}
+	res.Add = time.Since(start)
+
+	stump.VLog("  - reading back %s", hash)
+	start = time.Now()
+	c := node.command(ctx, "cat", hash)
+	c.Stdout = io.Discard
+	err = c.Run()
+	if err != nil {
+		return nil, fmt.Errorf("cat failed: %s", err)
+	}
+	res.Cat = time.Since(start)
+
+	stump.VLog("  - listing local refs")
+	start = time.Now()
+	c = node.command(ctx, "refs", "local")
+	c.Stdout = io.Discard
+	err = c.Run()
+	if err != nil {
+		return nil, fmt.Errorf("refs local failed: %s", err)
+	}
+	res.RefsLocal = time.Since(start)
+
+	stump.VLog("  - idling for %s", opts.Idle)
+	err = sleep(ctx, opts.Idle)
+	if err != nil {
+		return nil, err
+	}
+	res.IdleRSS, err = processRSS(d.p.Pid)
+	if err != nil {
+		stump.VLog("  - could not measure daemon memory: %s", err)
+	}
+
+	return res, nil
+}
+
+// writeBenchData writes size bytes of seeded random data to path.
+func writeBenchData(path string, size int64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := rand.New(rand.NewSource(benchSeed))
+	_, err = io.CopyN(f, r, size)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// pollApi waits for the api of the daemon in ipfspath to accept connections,
+// polling often enough to measure startup time.
+func pollApi(ctx context.Context, ipfspath string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		ep, err := util.ApiEndpoint(ipfspath)
+		if err == nil {
+			c, err := ep.Dial(ctx)
+			if err == nil {
+				c.Close()
+				return nil
+			}
+		}
+		err = sleep(ctx, 10*time.Millisecond)
+		if err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("failed to come online within %s", timeout)
+}
+
+// median returns the median of the measurement selected by get, the mean of
+// the two middle values for an even number of runs.
+func median(rs []*BenchResult, get func(*BenchResult) int64) int64 {
+	vals := make([]int64, len(rs))
+	for i, r := range rs {
+		vals[i] = get(r)
+	}
+	sort.Slice(vals, func(i, j int) bool { return vals[i] < vals[j] })
+	mid := len(vals) / 2
+	if len(vals)%2 == 0 {
+		return vals[mid-1] + (vals[mid]-vals[mid-1])/2
+	}
+	return vals[mid]
+}
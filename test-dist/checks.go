@@ -0,0 +1,233 @@
+package testdist
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	util "github.com/ipfs/ipfs-update/util"
+	stump "github.com/whyrusleeping/stump"
+)
+
+var checkClient = &http.Client{Timeout: 30 * time.Second}
+
+// gatewayEndpoint returns the address:port the gateway of the daemon running
+// in ipfspath listens on. Newer versions write it to the gateway file in the
+// repo, older ones only print it to stdout when starting up.
+func gatewayEndpoint(ctx context.Context, ipfspath string) (string, error) {
+	for i := 0; i < 15; i++ {
+		data, err := os.ReadFile(filepath.Join(ipfspath, "gateway"))
+		if err == nil {
+			ep := strings.TrimPrefix(strings.TrimSpace(string(data)), "http://")
+			stump.VLog("  - found gateway file: %s", ep)
+			return ep, nil
+		}
+
+		out, err := os.ReadFile(filepath.Join(ipfspath, "daemon.stdout"))
+		if err != nil {
+			return "", err
+		}
+		if maddr := gatewayListenAddr(string(out)); maddr != "" {
+			addr, err := util.ParseApiAddr(maddr)
+			if err != nil || addr.Network == "unix" {
+				return "", fmt.Errorf("incorrectly formatted gateway address: %q", maddr)
+			}
+			stump.VLog("  - found gateway address in daemon output: %s", maddr)
+			return addr.Address, nil
+		}
+
+		err = sleep(ctx, time.Millisecond*(100*time.Duration(i+1)))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return "", fmt.Errorf("could not find gateway address")
+}
+
+// gatewayListenAddr returns the multiaddr of the gateway in the startup output
+// of a daemon, or "" if it is not there (yet). Older versions print
+// "Gateway (readonly) server listening on", newer ones "Gateway server
+// listening on".
+func gatewayListenAddr(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, "Gateway (") && !strings.HasPrefix(line, "Gateway server ") {
+			continue
+		}
+		idx := strings.Index(line, "listening on ")
+		if idx < 0 {
+			continue
+		}
+		return strings.TrimSpace(line[idx+len("listening on "):])
+	}
+	return ""
+}
+
+func testGateway(ctx context.Context, tdir, hash string) error {
+	stump.VLog("  - checking that the test file can be fetched through the gateway")
+	ep, err := gatewayEndpoint(ctx, tdir)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+ep+"/ipfs/"+hash, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := checkClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("gateway returned %s: %s", resp.Status, string(body))
+	}
+
+	if string(body) != string(testText) {
+		return fmt.Errorf("gateway returned unexpected content: %q", string(body))
+	}
+
+	if xp := resp.Header.Get("X-Ipfs-Path"); xp != "/ipfs/"+hash {
+		return fmt.Errorf("gateway returned unexpected X-Ipfs-Path header: %q", xp)
+	}
+
+	return nil
+}
+
+// apiClient returns a client for requests to the api at ep.
+func apiClient(ep util.ApiAddr) *http.Client {
+	return &http.Client{
+		Timeout:   checkClient.Timeout,
+		Transport: ep.Transport(),
+	}
+}
+
+// rpcCall POSTs to an RPC API command of the daemon listening on endpoint
+// and decodes the JSON response into out.
+func rpcCall(ctx context.Context, endpoint util.ApiAddr, cmd string, out interface{}, args ...string) error {
+	vals := make(url.Values)
+	for _, a := range args {
+		vals.Add("arg", a)
+	}
+
+	u := fmt.Sprintf("%s/api/v0/%s?%s", endpoint.URL(), cmd, vals.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := apiClient(endpoint).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s returned %s: %s", cmd, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func testRPC(ctx context.Context, tdir, version, hash string) error {
+	ep, err := util.ApiEndpoint(tdir)
+	if err != nil {
+		return err
+	}
+
+	stump.VLog("  - checking rpc api version")
+	var vout struct {
+		Version string
+	}
+	err = rpcCall(ctx, ep, "version", &vout)
+	if err != nil {
+		return err
+	}
+	if !versionMatch(vout.Version, version[1:]) {
+		return fmt.Errorf("api version didnt match (expected '%s', got '%s')", version[1:], vout.Version)
+	}
+
+	if !util.BeforeVersion("v0.5.0", version) {
+		// v0.5.0 stopped accepting GET requests on the rpc api
+		stump.VLog("  - checking that rpc api rejects GET requests")
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, ep.URL()+"/api/v0/version", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := apiClient(ep).Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			return fmt.Errorf("expected GET on rpc api to be rejected, got %s", resp.Status)
+		}
+	}
+
+	stump.VLog("  - checking rpc api id")
+	var idout struct {
+		ID           string
+		AgentVersion string
+	}
+	err = rpcCall(ctx, ep, "id", &idout)
+	if err != nil {
+		return err
+	}
+	if idout.ID == "" {
+		return fmt.Errorf("id returned no peer id")
+	}
+	agent := "kubo/"
+	if util.BeforeVersion("v0.14.0", version) {
+		// v0.14.0 renamed go-ipfs to kubo
+		agent = "go-ipfs/"
+	}
+	if !strings.HasPrefix(idout.AgentVersion, agent) {
+		return fmt.Errorf("unexpected agent version (expected prefix '%s', got '%s')", agent, idout.AgentVersion)
+	}
+
+	stump.VLog("  - checking rpc api block/stat")
+	var bout struct {
+		Key  string
+		Size int
+	}
+	err = rpcCall(ctx, ep, "block/stat", &bout, hash)
+	if err != nil {
+		return err
+	}
+	if bout.Key != hash {
+		return fmt.Errorf("block/stat returned unexpected key (expected '%s', got '%s')", hash, bout.Key)
+	}
+	if bout.Size <= len(testText) {
+		return fmt.Errorf("block/stat returned unexpected size %d", bout.Size)
+	}
+
+	stump.VLog("  - checking rpc api dag/get")
+	dout := make(map[string]interface{})
+	err = rpcCall(ctx, ep, "dag/get", &dout, hash)
+	if err != nil {
+		return err
+	}
+	links := "Links"
+	if util.BeforeVersion("v0.10.0", version) {
+		// v0.10.0 switched dag/get output to dag-json
+		links = "links"
+	}
+	if _, ok := dout[links]; !ok {
+		return fmt.Errorf("dag/get output has no %q field", links)
+	}
+
+	return nil
+}
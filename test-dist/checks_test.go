@@ -0,0 +1,38 @@
+package testdist
+
+import "testing"
+
+func TestGatewayListenAddr(t *testing.T) {
+	cases := []struct {
+		out  string
+		addr string
+	}{
+		{
+			out:  "API server listening on /ip4/127.0.0.1/tcp/5001\nGateway (readonly) server listening on /ip4/127.0.0.1/tcp/8080\nDaemon is ready\n",
+			addr: "/ip4/127.0.0.1/tcp/8080",
+		},
+		{
+			out:  "Gateway (writable) server listening on /ip4/127.0.0.1/tcp/41234\r\n",
+			addr: "/ip4/127.0.0.1/tcp/41234",
+		},
+		{
+			out:  "RPC API server listening on /ip4/127.0.0.1/tcp/5001\nWebUI: http://127.0.0.1:5001/webui\nGateway server listening on /ip4/127.0.0.1/tcp/36789\nDaemon is ready\n",
+			addr: "/ip4/127.0.0.1/tcp/36789",
+		},
+		{
+			out:  "Initializing daemon...\nRPC API server listening on /ip4/127.0.0.1/tcp/5001\n",
+			addr: "",
+		},
+		{
+			out:  "",
+			addr: "",
+		},
+	}
+
+	for _, c := range cases {
+		addr := gatewayListenAddr(c.out)
+		if addr != c.addr {
+			t.Errorf("%q: expected %q, got %q", c.out, c.addr, addr)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package testdist
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	util "github.com/ipfs/ipfs-update/util"
+	stump "github.com/whyrusleeping/stump"
+)
+
+const (
+	// exchangeSize is the amount of random data transferred between test
+	// nodes, large enough to span multiple blocks.
+	exchangeSize = 1024 * 1024
+	// exchangeTimeout bounds how long retrieving data from a peer may take.
+	exchangeTimeout = time.Minute
+)
+
+// testNode is a daemon running in a staging repo.
+type testNode struct {
+	dir    string
+	bin    string
+	daemon *daemon
+}
+
+// startTestNode initializes a fresh repo under staging with bin and starts a
+// daemon in it.
+func startTestNode(ctx context.Context, staging, bin string) (*testNode, error) {
+	dir, err := os.MkdirTemp(staging, "peer")
+	if err != nil {
+		return nil, err
+	}
+
+	n := &testNode{dir: dir, bin: bin}
+
+	stump.VLog("  - running init in '%s' with %s", dir, bin)
+	_, err = runCmd(ctx, dir, bin, "init")
+	if err != nil {
+		n.Close()
+		return nil, fmt.Errorf("error initializing peer: %s", err)
+	}
+
+	err = tweakConfig(dir, Checks{})
+	if err != nil {
+		n.Close()
+		return nil, err
+	}
+
+	n.daemon, err = startDaemon(ctx, dir, bin)
+	if err != nil {
+		n.Close()
+		return nil, fmt.Errorf("error starting peer daemon: %s", err)
+	}
+
+	return n, nil
+}
+
+// Close stops the daemon of the node and removes its repo.
+func (n *testNode) Close() error {
+	if n.daemon != nil {
+		stump.VLog("  - killing peer daemon")
+		err := n.daemon.Close()
+		if err != nil {
+			stump.VLog("  - error killing peer daemon: %s (continuing anyway)", err)
+		}
+	}
+
+	err := os.RemoveAll(n.dir)
+	if err != nil {
+		stump.Error("error cleaning up staging directory: ", err)
+	}
+	return err
+}
+
+func (n *testNode) command(ctx context.Context, args ...string) *exec.Cmd {
+	c := exec.CommandContext(ctx, n.bin, args...)
+	if runtime.GOOS == "windows" {
+		c.Env = os.Environ()
+	}
+	c.Env = replaceEnvVarIfExists(c.Env, "IPFS_PATH", n.dir)
+	return c
+}
+
+// loopbackAddr returns the loopback swarm address of the node, including
+// its peer id.
+func (n *testNode) loopbackAddr(ctx context.Context) (string, error) {
+	out, err := runCmd(ctx, n.dir, n.bin, "id")
+	if err != nil {
+		return "", err
+	}
+
+	var id struct {
+		ID        string
+		Addresses []string
+	}
+	err = json.Unmarshal([]byte(out), &id)
+	if err != nil {
+		return "", fmt.Errorf("could not parse id output: %s", err)
+	}
+
+	for _, a := range id.Addresses {
+		if strings.HasPrefix(a, "/ip4/127.0.0.1/tcp/") {
+			return a, nil
+		}
+	}
+
+	return "", fmt.Errorf("peer %s has no loopback tcp address", id.ID)
+}
+
+// connectNodes connects node a to node b over loopback.
+func connectNodes(ctx context.Context, a, b *testNode) error {
+	addr, err := b.loopbackAddr(ctx)
+	if err != nil {
+		return err
+	}
+
+	stump.VLog("  - connecting to %s", addr)
+	_, err = runCmd(ctx, a.dir, a.bin, "swarm", "connect", addr)
+	return err
+}
+
+// testExchange adds random data on node from and checks that node to can
+// retrieve it from there.
+func testExchange(ctx context.Context, from, to *testNode) error {
+	data := make([]byte, exchangeSize)
+	_, err := rand.Read(data)
+	if err != nil {
+		return err
+	}
+
+	testFile := filepath.Join(from.dir, "exchange.bin")
+	err = os.WriteFile(testFile, data, 0o644)
+	if err != nil {
+		return err
+	}
+
+	hash, err := runCmd(ctx, from.dir, from.bin, "add", "-q", "--progress=false", testFile)
+	if err != nil {
+		return fmt.Errorf("add failed: %s", err)
+	}
+
+	stump.VLog("  - retrieving %s from peer", hash)
+	catCtx, cancel := context.WithTimeout(ctx, exchangeTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	c := to.command(catCtx, "cat", hash)
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if catCtx.Err() != nil {
+			return fmt.Errorf("timed out retrieving %s from peer", hash)
+		}
+		return fmt.Errorf("cat failed: %s: %s", err, stderr.String())
+	}
+
+	if !bytes.Equal(out, data) {
+		return fmt.Errorf("data retrieved from peer does not match")
+	}
+
+	return nil
+}
+
+// testNetwork starts a second daemon from bin, connects it to the one
+// running in tdir over loopback and retrieves content from it via bitswap.
+func testNetwork(ctx context.Context, staging, tdir, bin, version string) error {
+	if util.BeforeVersion("v0.3.8", version) {
+		stump.Log("== skipping network test, versions before 0.3.8 do not support port zero ==")
+		return nil
+	}
+
+	stump.VLog("  - starting a second node to check networking")
+	peer, err := startTestNode(ctx, staging, bin)
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+
+	node := &testNode{dir: tdir, bin: bin}
+	err = connectNodes(ctx, peer, node)
+	if err != nil {
+		return fmt.Errorf("swarm connect failed: %s", err)
+	}
+
+	return testExchange(ctx, node, peer)
+}
+
+// testInterop starts a daemon from oldBin and one from newBin, connects them
+// over loopback and exchanges content in both directions.
+func testInterop(ctx context.Context, staging, oldBin, newBin string) error {
+	out, err := runCmd(ctx, staging, oldBin, "version")
+	if err != nil {
+		return err
+	}
+	parts := strings.Fields(out)
+	if len(parts) == 0 {
+		return fmt.Errorf("no version output from %s", oldBin)
+	}
+	oldVersion := "v" + parts[len(parts)-1]
+	if util.BeforeVersion("v0.3.8", oldVersion) {
+		stump.Log("== skipping interop test, the installed %s does not support port zero ==", oldVersion)
+		return nil
+	}
+
+	stump.VLog("  - starting a node from the installed binary to check interop")
+	oldNode, err := startTestNode(ctx, staging, oldBin)
+	if err != nil {
+		return err
+	}
+	defer oldNode.Close()
+
+	newNode, err := startTestNode(ctx, staging, newBin)
+	if err != nil {
+		return err
+	}
+	defer newNode.Close()
+
+	err = connectNodes(ctx, newNode, oldNode)
+	if err != nil {
+		return fmt.Errorf("swarm connect failed: %s", err)
+	}
+
+	stump.VLog("  - retrieving content added by old binary with new binary")
+	err = testExchange(ctx, oldNode, newNode)
+	if err != nil {
+		return fmt.Errorf("old to new: %s", err)
+	}
+
+	stump.VLog("  - retrieving content added by new binary with old binary")
+	err = testExchange(ctx, newNode, oldNode)
+	if err != nil {
+		return fmt.Errorf("new to old: %s", err)
+	}
+
+	return nil
+}
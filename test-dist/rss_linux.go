@@ -0,0 +1,36 @@
+package testdist
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// processRSS returns the resident set size of the process with the given pid
+// in bytes.
+func processRSS(pid int) (int64, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		fields := strings.Fields(scan.Text())
+		if len(fields) < 2 || fields[0] != "VmRSS:" {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("could not parse VmRSS: %s", err)
+		}
+		return kb * 1024, nil
+	}
+	if scan.Err() != nil {
+		return 0, scan.Err()
+	}
+	return 0, fmt.Errorf("no VmRSS in process status")
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package testdist
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// processRSS is only implemented on linux.
+func processRSS(pid int) (int64, error) {
+	return 0, fmt.Errorf("measuring process memory is not supported on %s", runtime.GOOS)
+}
@@ -1,10 +1,11 @@
 package testdist
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -17,8 +18,8 @@ import (
 	stump "github.com/whyrusleeping/stump"
 )
 
-func runCmd(p, bin string, args ...string) (string, error) {
-	cmd := exec.Command(bin, args...)
+func runCmd(ctx context.Context, p, bin string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, bin, args...)
 	if runtime.GOOS == "windows" {
 		cmd.Env = os.Environ()
 	}
@@ -33,20 +34,23 @@ func runCmd(p, bin string, args ...string) (string, error) {
 }
 
 type daemon struct {
+	cmd    *exec.Cmd
 	p      *os.Process
 	stderr io.WriteCloser
 	stdout io.WriteCloser
 }
 
 func (d *daemon) Close() error {
+	// the daemon is already gone if its context was cancelled
 	err := d.p.Kill()
-	if err != nil {
+	if err != nil && !errors.Is(err, os.ErrProcessDone) {
 		stump.Error("error killing daemon: %s", err)
 		return err
 	}
 
-	_, err = d.p.Wait()
-	if err != nil {
+	err = d.cmd.Wait()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
 		stump.Error("error waiting on killed daemon: %s", err)
 		return err
 	}
@@ -56,7 +60,7 @@ func (d *daemon) Close() error {
 	return nil
 }
 
-func tweakConfig(ipfspath string) error {
+func tweakConfig(ipfspath string, checks Checks) error {
 	cfgpath := filepath.Join(ipfspath, "config")
 	cfg := make(map[string]interface{})
 	cfgbytes, err := os.ReadFile(cfgpath)
@@ -78,6 +82,9 @@ func tweakConfig(ipfspath string) error {
 
 	addrs["API"] = "/ip4/127.0.0.1/tcp/0"
 	addrs["Gateway"] = ""
+	if checks.Gateway {
+		addrs["Gateway"] = "/ip4/127.0.0.1/tcp/0"
+	}
 	addrs["Swarm"] = []string{"/ip4/0.0.0.0/tcp/0"}
 
 	_, ok = cfg["Bootstrap"].([]interface{})
@@ -100,8 +107,10 @@ func tweakConfig(ipfspath string) error {
 	return nil
 }
 
-func startDaemon(p, bin string) (io.Closer, error) {
-	cmd := exec.Command(bin, "daemon", "--debug")
+// spawnDaemon starts a daemon in p without waiting for it to come online.
+// The daemon is killed when ctx is cancelled.
+func spawnDaemon(ctx context.Context, p, bin string) (*daemon, error) {
+	cmd := exec.CommandContext(ctx, bin, "daemon", "--debug")
 
 	stdout, err := os.Create(filepath.Join(p, "daemon.stdout"))
 	if err != nil {
@@ -127,22 +136,33 @@ func startDaemon(p, bin string) (io.Closer, error) {
 		return nil, fmt.Errorf("failed to start daemon: %s", err)
 	}
 
-	// now wait for api to become live
-	err = waitForApi(p)
-	if err != nil {
-		return nil, err
-	}
-
 	return &daemon{
+		cmd:    cmd,
 		p:      cmd.Process,
 		stderr: stderr,
 		stdout: stdout,
 	}, nil
 }
 
-func waitForApi(ipfspath string) error {
+func startDaemon(ctx context.Context, p, bin string) (*daemon, error) {
+	d, err := spawnDaemon(ctx, p, bin)
+	if err != nil {
+		return nil, err
+	}
+
+	// now wait for api to become live
+	err = waitForApi(ctx, p)
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func waitForApi(ctx context.Context, ipfspath string) error {
 	stump.VLog("  - waiting on daemon to come online")
-	var endpoint string
+	var endpoint util.ApiAddr
 	nloops := 15
 	var success bool
 	for i := 0; i < nloops; i++ {
@@ -157,16 +177,19 @@ func waitForApi(ipfspath string) error {
 			return err
 		}
 
-		time.Sleep(time.Millisecond * (100 * time.Duration(i+1)))
+		err = sleep(ctx, time.Millisecond*(100*time.Duration(i+1)))
+		if err != nil {
+			return err
+		}
 	}
 
 	if !success {
 		stump.VLog("  - no api file found, trying fallback (happens pre 0.3.8)")
-		endpoint = "localhost:5001"
+		endpoint = util.ApiAddr{Network: "tcp", Address: "localhost:5001"}
 	}
 
 	for i := 0; i < 10; i++ {
-		c, err := net.Dial("tcp", endpoint)
+		c, err := endpoint.Dial(ctx)
 		if err == nil {
 			c.Close()
 			stump.VLog("  - Successfully made connection to api endpoint")
@@ -174,13 +197,63 @@ func waitForApi(ipfspath string) error {
 		}
 		stump.VLog("  - connecting to api endpoint failed: %s", err)
 
-		time.Sleep(time.Millisecond * (100 * time.Duration(i+1)))
+		err = sleep(ctx, time.Millisecond*(100*time.Duration(i+1)))
+		if err != nil {
+			return err
+		}
 	}
 
 	return fmt.Errorf("failed to come online")
 }
 
-func TestBinary(bin, version string) error {
+// sleep waits for d, or returns early with the error of ctx if it is
+// cancelled.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stagingDir returns the directory test repos are created in, creating it if
+// needed.
+func stagingDir() (string, error) {
+	ipfsDir, err := migrations.IpfsDir("")
+	if err != nil {
+		return "", fmt.Errorf("cannot find ipfs directory: %s", err)
+	}
+	staging := filepath.Join(ipfsDir, "update-staging")
+	err = os.MkdirAll(staging, 0o755)
+	if err != nil {
+		return "", fmt.Errorf("error creating test staging directory: %s", err)
+	}
+	return staging, nil
+}
+
+// Checks selects the optional checks TestBinary runs in addition to the
+// basic init, add, cat and refs tests.
+type Checks struct {
+	// Gateway binds the HTTP gateway on an ephemeral port and fetches the
+	// test file through it.
+	Gateway bool
+	// API calls a few RPC API endpoints directly over HTTP.
+	API bool
+	// Network starts a second daemon, connects the two over loopback and
+	// retrieves content from one on the other.
+	Network bool
+	// Interop is the path of a previously installed binary. If set, a daemon
+	// from it and one from the new binary exchange content in both
+	// directions.
+	Interop string
+}
+
+// TestBinary runs the version at bin in a staging repo and checks that it
+// works. Cancelling ctx kills any daemons it started.
+func TestBinary(ctx context.Context, bin, version string, checks Checks) error {
 	_, err := os.Stat(bin)
 	if err != nil {
 		return err
@@ -192,14 +265,9 @@ func TestBinary(bin, version string) error {
 		return err
 	}
 
-	ipfsDir, err := migrations.IpfsDir("")
+	staging, err := stagingDir()
 	if err != nil {
-		return fmt.Errorf("cannot find ipfs directory: %s", err)
-	}
-	staging := filepath.Join(ipfsDir, "update-staging")
-	err = os.MkdirAll(staging, 0o755)
-	if err != nil {
-		return fmt.Errorf("error creating test staging directory: %s", err)
+		return err
 	}
 
 	tdir, err := os.MkdirTemp(staging, "test")
@@ -221,13 +289,13 @@ func TestBinary(bin, version string) error {
 	}(tdir)
 
 	stump.VLog("  - running init in '%s' with new binary", tdir)
-	_, err = runCmd(tdir, bin, "init")
+	_, err = runCmd(ctx, tdir, bin, "init")
 	if err != nil {
 		return fmt.Errorf("error initializing with new binary: %s", err)
 	}
 
 	stump.VLog("  - checking new binary outputs correct version")
-	rversion, err := runCmd(tdir, bin, "version")
+	rversion, err := runCmd(ctx, tdir, bin, "version")
 	if err != nil {
 		return err
 	}
@@ -244,13 +312,13 @@ func TestBinary(bin, version string) error {
 
 	// set up ports in config so we dont interfere with an already running daemon
 	stump.VLog("  - tweaking test config to avoid external interference")
-	err = tweakConfig(tdir)
+	err = tweakConfig(tdir, checks)
 	if err != nil {
 		return err
 	}
 
 	stump.VLog("  - starting up daemon")
-	daemon, err := startDaemon(tdir, bin)
+	daemon, err := startDaemon(ctx, tdir, bin)
 	if err != nil {
 		return fmt.Errorf("error starting daemon: %s", err)
 	}
@@ -263,7 +331,7 @@ func TestBinary(bin, version string) error {
 	}()
 
 	// test some basic things against the daemon
-	err = testFileAdd(tdir, bin)
+	hash, err := testFileAdd(ctx, tdir, bin)
 	if err != nil {
 		return fmt.Errorf("test file add: %s", err)
 	}
@@ -274,10 +342,38 @@ func TestBinary(bin, version string) error {
 		expectedCID = "QmTFJQ68kaArzsqz2Yjg1yMyEA5TXTfNw6d9wSFhxtBxz2"
 	}
 
-	err = testRefsList(tdir, bin, expectedCID)
+	err = testRefsList(ctx, tdir, bin, expectedCID)
 	if err != nil {
 		return fmt.Errorf("test refs list: %s", err)
 	}
+
+	if checks.Gateway {
+		err = testGateway(ctx, tdir, hash)
+		if err != nil {
+			return fmt.Errorf("test gateway: %s", err)
+		}
+	}
+
+	if checks.API {
+		err = testRPC(ctx, tdir, version, hash)
+		if err != nil {
+			return fmt.Errorf("test rpc api: %s", err)
+		}
+	}
+
+	if checks.Network {
+		err = testNetwork(ctx, staging, tdir, bin, version)
+		if err != nil {
+			return fmt.Errorf("test network: %s", err)
+		}
+	}
+
+	if checks.Interop != "" {
+		err = testInterop(ctx, staging, checks.Interop, bin)
+		if err != nil {
+			return fmt.Errorf("test interop with %s: %s", checks.Interop, err)
+		}
+	}
 	stump.Log("success! tests all passed.")
 
 	return nil
@@ -293,16 +389,19 @@ func versionMatch(a, b string) bool {
 	return a == b
 }
 
-func testFileAdd(tdir, bin string) error {
+// testText is the content of the file added by testFileAdd.
+var testText = []byte("hello world! This node should work")
+
+func testFileAdd(ctx context.Context, tdir, bin string) (string, error) {
 	stump.VLog("  - checking that we can add and cat a file")
-	text := []byte("hello world! This node should work")
+	text := testText
 	testFile := filepath.Join(tdir, "/test.txt")
 	err := os.WriteFile(testFile, text, 0o644)
 	if err != nil {
 		stump.Error("testfileadd could not create test file: %s", err)
 	}
 
-	c := exec.Command(bin, "add", "-q", "--progress=false", testFile)
+	c := exec.CommandContext(ctx, bin, "add", "-q", "--progress=false", testFile)
 	if runtime.GOOS == "windows" {
 		c.Env = os.Environ()
 	}
@@ -311,25 +410,25 @@ func testFileAdd(tdir, bin string) error {
 	if err != nil {
 		stump.Error("testfileadd fail: %s", err)
 		stump.Error(string(out))
-		return err
+		return "", err
 	}
 
 	hash := strings.Trim(string(out), "\n \t\r")
-	fiout, err := runCmd(tdir, bin, "cat", hash)
+	fiout, err := runCmd(ctx, tdir, bin, "cat", hash)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	if fiout != string(text) {
-		return fmt.Errorf("add/cat check failed")
+		return "", fmt.Errorf("add/cat check failed")
 	}
 
-	return nil
+	return hash, nil
 }
 
-func testRefsList(tdir, bin, expectedCID string) error {
+func testRefsList(ctx context.Context, tdir, bin, expectedCID string) error {
 	stump.VLog("  - checking that file shows up in ipfs refs local")
-	c := exec.Command(bin, "refs", "local")
+	c := exec.CommandContext(ctx, bin, "refs", "local")
 	if runtime.GOOS == "windows" {
 		c.Env = os.Environ()
 	}
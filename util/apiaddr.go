@@ -0,0 +1,117 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// ApiAddr is the location of an ipfs RPC api.
+type ApiAddr struct {
+	// Network is "unix" for unix sockets, and a tcp network otherwise.
+	Network string
+	// Address is the host:port to connect to, or the path of the socket.
+	Address string
+	// HTTPS is set if the api is served over TLS.
+	HTTPS bool
+	// Path is the path the api is served under, e.g. behind a reverse
+	// proxy, "" for the root.
+	Path string
+}
+
+// ParseApiAddr parses the address of an ipfs RPC api, either a multiaddr such
+// as "/ip4/127.0.0.1/tcp/5001", "/dns4/node.internal/tcp/5001/https" or
+// "/unix/run/ipfs.sock", or an http(s) URL, whose path is kept as the prefix
+// of the api.
+func ParseApiAddr(s string) (ApiAddr, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return ApiAddr{}, fmt.Errorf("invalid api url %q: %s", s, err)
+		}
+		if u.Host == "" {
+			return ApiAddr{}, fmt.Errorf("invalid api url %q: no host", s)
+		}
+		if u.RawQuery != "" || u.Fragment != "" {
+			return ApiAddr{}, fmt.Errorf("invalid api url %q: unexpected query or fragment", s)
+		}
+		return ApiAddr{
+			Network: "tcp",
+			Address: u.Host,
+			HTTPS:   u.Scheme == "https",
+			Path:    strings.TrimRight(u.EscapedPath(), "/"),
+		}, nil
+	}
+
+	m, err := ma.NewMultiaddr(s)
+	if err != nil {
+		return ApiAddr{}, fmt.Errorf("invalid api address %q: %s", s, err)
+	}
+	network, addr, err := manet.DialArgs(m)
+	if err != nil {
+		return ApiAddr{}, fmt.Errorf("invalid api address %q: %s", s, err)
+	}
+	if network != "unix" && !strings.HasPrefix(network, "tcp") {
+		return ApiAddr{}, fmt.Errorf("invalid api address %q: not a tcp or unix address", s)
+	}
+
+	a := ApiAddr{Network: network, Address: addr}
+	ma.ForEach(m, func(c ma.Component) bool {
+		switch c.Protocol().Code {
+		case ma.P_HTTPS, ma.P_TLS:
+			a.HTTPS = true
+		}
+		return true
+	})
+	return a, nil
+}
+
+// URL returns the base URL of the api. Requests to a unix socket use the
+// placeholder host "unix", and must be dialed with Dial.
+func (a ApiAddr) URL() string {
+	scheme := "http"
+	if a.HTTPS {
+		scheme = "https"
+	}
+	host := a.Address
+	if a.Network == "unix" {
+		host = "unix"
+	}
+	return scheme + "://" + host + a.Path
+}
+
+// Dial connects to the api.
+func (a ApiAddr) Dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, a.Network, a.Address)
+}
+
+// Transport returns an http transport for requests to the api, which
+// connects to its unix socket if it has one.
+func (a ApiAddr) Transport() *http.Transport {
+	tpt := &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		DisableKeepAlives: true,
+	}
+	if a.Network == "unix" {
+		tpt.Proxy = nil
+		tpt.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return a.Dial(ctx)
+		}
+	}
+	return tpt
+}
+
+func (a ApiAddr) String() string {
+	if a.Network == "unix" {
+		return "unix:" + a.Address
+	}
+	return a.URL()
+}
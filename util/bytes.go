@@ -0,0 +1,69 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var byteUnits = []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+// HumanBytes formats a byte count using binary units, e.g. "1.5 MiB".
+func HumanBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	v := float64(n)
+	i := 0
+	for v >= 1024 && i < len(byteUnits)-1 {
+		v /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", v, byteUnits[i])
+}
+
+var byteMultipliers = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1000,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1000 * 1000,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1000 * 1000 * 1000,
+	"gib": 1 << 30,
+}
+
+// ParseBytes parses a byte count such as "512", "1.5MiB" or "10 MB". Units
+// ending in "iB" and single letter units are binary, "KB", "MB" and "GB" are
+// decimal.
+func ParseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+
+	num, unit := s[:i], strings.ToLower(strings.TrimSpace(s[i:]))
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid byte count %q", s)
+	}
+	mult, ok := byteMultipliers[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q in %q", s[i:], s)
+	}
+	return int64(v * float64(mult)), nil
+}
+
+// ParseRate parses a transfer rate in bytes per second, such as "2MiB/s".
+// The "/s" suffix is optional.
+func ParseRate(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "/s")
+	return ParseBytes(s)
+}
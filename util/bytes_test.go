@@ -0,0 +1,70 @@
+package util
+
+import "testing"
+
+func TestHumanBytes(t *testing.T) {
+	cases := map[int64]string{
+		0:                      "0 B",
+		1023:                   "1023 B",
+		1024:                   "1.0 KiB",
+		1536:                   "1.5 KiB",
+		64 * 1024 * 1024:       "64.0 MiB",
+		3 * 1024 * 1024 * 1024: "3.0 GiB",
+	}
+
+	for n, expected := range cases {
+		if got := HumanBytes(n); got != expected {
+			t.Errorf("HumanBytes(%d): expected %q, got %q", n, expected, got)
+		}
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	cases := map[string]int64{
+		"0":       0,
+		"512":     512,
+		"512B":    512,
+		"2k":      2048,
+		"2KiB":    2048,
+		"2KB":     2000,
+		"1.5MiB":  3 << 19,
+		"10 MB":   10000000,
+		"1GiB":    1 << 30,
+		" 3 mib ": 3 << 20,
+	}
+
+	for s, expected := range cases {
+		got, err := ParseBytes(s)
+		if err != nil {
+			t.Errorf("ParseBytes(%q): %s", s, err)
+			continue
+		}
+		if got != expected {
+			t.Errorf("ParseBytes(%q): expected %d, got %d", s, expected, got)
+		}
+	}
+
+	for _, s := range []string{"", "MiB", "-1", "1.2.3", "5 parsecs"} {
+		if _, err := ParseBytes(s); err == nil {
+			t.Errorf("ParseBytes(%q): expected an error", s)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	got, err := ParseRate("2MiB/s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 2<<20 {
+		t.Errorf("expected %d, got %d", 2<<20, got)
+	}
+
+	got, err = ParseRate("500k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 500<<10 {
+		t.Errorf("expected %d, got %d", 500<<10, got)
+	}
+}
@@ -0,0 +1,71 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrLocked is returned by TryLock when another process holds the lock.
+var ErrLocked = errors.New("lock is held by another process")
+
+// Lock is an exclusive advisory lock on a file. The lock is released when
+// the process exits, so a crashed process never leaves a stale lock behind.
+type Lock struct {
+	f *os.File
+}
+
+// TryLock takes the lock on the file at path, creating it if necessary, and
+// records the pid of this process in it. It returns ErrLocked without
+// blocking if another process holds the lock.
+func TryLock(path string) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lockFile(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// the file is never removed, as that would let another process lock a
+	// new file while this one is still being waited on
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	if err != nil {
+		unlockFile(f)
+		f.Close()
+		return nil, err
+	}
+
+	return &Lock{f: f}, nil
+}
+
+// Close releases the lock.
+func (l *Lock) Close() error {
+	err := unlockFile(l.f)
+	cerr := l.f.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// LockHolder returns the pid recorded in the lock file at path, or 0 if it
+// cannot be read.
+func LockHolder(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
@@ -0,0 +1,39 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly || windows
+
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTryLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lock")
+
+	l, err := TryLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pid := LockHolder(path); pid != os.Getpid() {
+		t.Errorf("expected lock holder %d, got %d", os.Getpid(), pid)
+	}
+
+	_, err = TryLock(path)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = TryLock(path)
+	if err != nil {
+		t.Fatalf("could not lock after release: %s", err)
+	}
+	l.Close()
+}
@@ -0,0 +1,91 @@
+package util
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the combined rate of the transfers sharing it, using a
+// token bucket that holds up to a tenth of a second worth of bytes.
+type RateLimiter struct {
+	rate  float64
+	burst int
+
+	mu    sync.Mutex
+	avail float64
+	last  time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing rate bytes per second.
+func NewRateLimiter(rate int64) *RateLimiter {
+	burst := int(rate / 10)
+	if burst < 1024 {
+		burst = 1024
+	}
+	return &RateLimiter{
+		rate:  float64(rate),
+		burst: burst,
+		avail: float64(burst),
+		last:  time.Now(),
+	}
+}
+
+// Burst returns the largest number of bytes that should be transferred at
+// once.
+func (l *RateLimiter) Burst() int {
+	return l.burst
+}
+
+// Wait accounts for n bytes transferred, and blocks until the transfer is
+// back under the rate limit or ctx is cancelled.
+func (l *RateLimiter) Wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.avail = math.Min(l.avail+now.Sub(l.last).Seconds()*l.rate, float64(l.burst))
+	l.last = now
+	l.avail -= float64(n)
+	var d time.Duration
+	if l.avail < 0 {
+		d = time.Duration(-l.avail / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if d == 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// LimitReader returns a reader that reads from r no faster than l allows.
+func (l *RateLimiter) LimitReader(ctx context.Context, r io.Reader) io.Reader {
+	return &limitedReader{ctx: ctx, r: r, l: l}
+}
+
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *RateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.l.burst {
+		p = p[:r.l.burst]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.l.Wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,39 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	// 100 KiB/s with a 10 KiB burst, so 60 KiB take at least half a second
+	l := NewRateLimiter(100 << 10)
+	data := make([]byte, 60<<10)
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, l.LimitReader(context.Background(), bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) {
+		t.Fatalf("expected %d bytes, got %d", len(data), n)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("transfer took %s, expected at least 400ms", d)
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	l := NewRateLimiter(1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// the first read fits in the burst, the second has to wait
+	_, err := io.Copy(io.Discard, l.LimitReader(ctx, bytes.NewReader(make([]byte, 4096))))
+	if err != context.Canceled {
+		t.Fatalf("expected %s, got %v", context.Canceled, err)
+	}
+}
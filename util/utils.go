@@ -1,10 +1,12 @@
 package util
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -27,13 +29,39 @@ var (
 
 // [2018.06.06] This function is needed because os.Rename doesn't work across filesystem
 // boundaries.
-func CopyTo(src, dest string) error {
+//
+// The copy is written next to dest and renamed into place once complete, so
+// that dest is never left half-written, even if ctx is cancelled.
+func CopyTo(ctx context.Context, src, dest string) error {
 	fi, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 	defer fi.Close()
 
+	info, err := fi.Stat()
+	if err != nil {
+		return err
+	}
+
+	trgt, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := trgt.Name()
+	defer os.Remove(tmp)
+
+	_, err = io.Copy(trgt, ctxReader{ctx, fi})
+	if err == nil {
+		err = trgt.Chmod(info.Mode().Perm())
+	}
+	if cerr := trgt.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
 	if runtime.GOOS == "windows" {
 		// On windows, we need to remove this file first if it's in-use
 		// (i.e., IPFS is running).
@@ -42,18 +70,11 @@ func CopyTo(src, dest string) error {
 		}
 	}
 
-	trgt, err := os.Create(dest)
-	if err != nil {
-		return err
-	}
-	defer trgt.Close()
-
-	_, err = io.Copy(trgt, fi)
-	return err
+	return os.Rename(tmp, dest)
 }
 
-func Move(src, dest string) error {
-	err := CopyTo(src, dest)
+func Move(ctx context.Context, src, dest string) error {
+	err := CopyTo(ctx, src, dest)
 	if err != nil {
 		return err
 	}
@@ -61,6 +82,19 @@ func Move(src, dest string) error {
 	return forceRemove(src)
 }
 
+// ctxReader stops reading once its context is cancelled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
 func BeforeVersion(check, cur string) bool {
 	aparts := strings.Split(check[1:], ".")
 	bparts := strings.Split(cur[1:], ".")
@@ -84,24 +118,19 @@ func BeforeVersion(check, cur string) bool {
 }
 
 // ApiEndpoint reads the api file from the local ipfs install directory and
-// returns the address:port read from the file.  If the ipfs directory is not
-// specified then the default location is used.
-func ApiEndpoint(ipfsDir string) (string, error) {
+// returns the address of the api it names, which may be a tcp address, with
+// or without TLS, or a unix socket. If the ipfs directory is not specified
+// then the default location is used.
+func ApiEndpoint(ipfsDir string) (ApiAddr, error) {
 	ipfsDir, err := migrations.CheckIpfsDir(ipfsDir)
 	if err != nil {
-		return "", err
+		return ApiAddr{}, err
 	}
 
 	apiData, err := os.ReadFile(path.Join(ipfsDir, apiFile))
 	if err != nil {
-		return "", err
-	}
-
-	val := strings.TrimSpace(string(apiData))
-	parts := strings.Split(val, "/")
-	if len(parts) != 5 {
-		return "", fmt.Errorf("incorrectly formatted api string: %q", val)
+		return ApiAddr{}, err
 	}
 
-	return parts[2] + ":" + parts[4], nil
+	return ParseApiAddr(string(apiData))
 }
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"context"
 	"os"
 	"path"
 	"testing"
@@ -49,7 +50,7 @@ func TestApiEndpoint(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if val != "127.0.0.1:5001" {
+	if val.Address != "127.0.0.1:5001" {
 		t.Fatal("got unexpected value:", val)
 	}
 
@@ -61,3 +62,99 @@ func TestApiEndpoint(t *testing.T) {
 		t.Fatal("expected", val, "got", val2)
 	}
 }
+
+func TestCopyToCancelled(t *testing.T) {
+	dir := t.TempDir()
+	src := path.Join(dir, "src")
+	dest := path.Join(dir, "dest")
+
+	err := os.WriteFile(src, []byte("new"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(dest, []byte("old"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = CopyTo(ctx, src, dest)
+	if err == nil {
+		t.Fatal("expected copy to fail")
+	}
+
+	data, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "old" {
+		t.Errorf("dest was modified by cancelled copy: %q", data)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected temporary file to be removed, found %d files", len(entries))
+	}
+
+	err = CopyTo(context.Background(), src, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new" {
+		t.Errorf("expected dest to be replaced, got %q", data)
+	}
+}
+
+func TestParseApiAddr(t *testing.T) {
+	cases := map[string]ApiAddr{
+		"/ip4/127.0.0.1/tcp/5001":             {Network: "tcp4", Address: "127.0.0.1:5001"},
+		"/ip6/::1/tcp/5001":                   {Network: "tcp6", Address: "[::1]:5001"},
+		"/dns4/localhost/tcp/5001/http":       {Network: "tcp4", Address: "localhost:5001"},
+		"/dns4/node.internal/tcp/5001/https":  {Network: "tcp4", Address: "node.internal:5001", HTTPS: true},
+		"/dns/node.internal/tcp/443/tls/http": {Network: "tcp", Address: "node.internal:443", HTTPS: true},
+		"/unix/run/ipfs.sock":                 {Network: "unix", Address: "/run/ipfs.sock"},
+		"https://node.internal:5001":          {Network: "tcp", Address: "node.internal:5001", HTTPS: true},
+		" http://127.0.0.1:5001\n":            {Network: "tcp", Address: "127.0.0.1:5001"},
+		"https://node.internal/ipfs-api/":     {Network: "tcp", Address: "node.internal", HTTPS: true, Path: "/ipfs-api"},
+	}
+
+	for s, expected := range cases {
+		a, err := ParseApiAddr(s)
+		if err != nil {
+			t.Errorf("ParseApiAddr(%q): %s", s, err)
+			continue
+		}
+		if a != expected {
+			t.Errorf("ParseApiAddr(%q): expected %+v, got %+v", s, expected, a)
+		}
+	}
+
+	for _, s := range []string{"", "bad-data", "/ip4/127.0.0.1/udp/5001", "/ip4/127.0.0.1", "https://", "https://node.internal/?key=1"} {
+		if _, err := ParseApiAddr(s); err == nil {
+			t.Errorf("ParseApiAddr(%q): expected an error", s)
+		}
+	}
+}
+
+func TestApiAddrURL(t *testing.T) {
+	a := ApiAddr{Network: "tcp4", Address: "node.internal:5001", HTTPS: true}
+	if u := a.URL(); u != "https://node.internal:5001" {
+		t.Errorf("unexpected url %s", u)
+	}
+	a = ApiAddr{Network: "tcp", Address: "node.internal", Path: "/ipfs-api"}
+	if u := a.URL(); u != "http://node.internal/ipfs-api" {
+		t.Errorf("unexpected url %s", u)
+	}
+	a = ApiAddr{Network: "unix", Address: "/run/ipfs.sock"}
+	if u := a.URL(); u != "http://unix" {
+		t.Errorf("unexpected url %s", u)
+	}
+}